@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// Large volumes, and volumes of sensitive namespaces, are only deleted once an admin approved it: when their deletion
+// is due, they are marked as awaiting approval and admins are notified. `approve <pv>` records the approval.
+
+const (
+	// when the deletion of a PV requiring approval was first due
+	annotationAwaitingApproval = "reclaim-volumes.cern.ch/awaiting-deletion-approval"
+	// who approved the deletion, and when
+	annotationApprovedBy = "reclaim-volumes.cern.ch/deletion-approved-by"
+	annotationApprovedAt = "reclaim-volumes.cern.ch/deletion-approved-at"
+
+	auditDeletionApproved = "deletion-approved"
+)
+
+var (
+	approvalCapacityThreshold = flag.String("approvalCapacityThreshold", "", "PVs with a capacity of at least this quantity (e.g. 1Ti) are only deleted once approved with the approve command. Not used if empty")
+	approvalNamespaceSelector = flag.String("approvalNamespaceSelector", "", "label selector (e.g. 'data-classification=sensitive') of the namespaces whose PVs are only deleted once approved with the approve command. Not used if empty")
+	adminEmail                = flag.String("adminEmail", "", "recipient of the email notifications meant for admins (deletions awaiting approval)")
+	approvalReason            = flag.String("approvalReason", "", "approve command: why the deletion is approved")
+)
+
+// Why the deletion of a PV requires an approval, or an empty string if it does not
+func approvalRequiredFor(persV v1.PersistentVolume) (string, error) {
+	if *approvalCapacityThreshold != "" {
+		threshold, err := resource.ParseQuantity(*approvalCapacityThreshold)
+		if err != nil {
+			return "", fmt.Errorf("invalid -approvalCapacityThreshold '%s' - %v", *approvalCapacityThreshold, err)
+		}
+		if capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]; ok && capacity.Cmp(threshold) >= 0 {
+			return fmt.Sprintf("capacity %s is at least %s", capacity.String(), threshold.String()), nil
+		}
+	}
+	if claimRef := userClaimRef(persV); *approvalNamespaceSelector != "" && claimRef != nil {
+		selector, err := labels.Parse(*approvalNamespaceSelector)
+		if err != nil {
+			return "", fmt.Errorf("invalid -approvalNamespaceSelector '%s' - %v", *approvalNamespaceSelector, err)
+		}
+		namespaceName := claimRef.Namespace
+		namespace, found, err := getNamespace(namespaceName)
+		if err != nil {
+			return "", fmt.Errorf("listing namespaces - %v", err)
+		}
+		namespaceLabels := namespace.Labels
+		if !found {
+			// the namespace is gone: use the labels captured while the PVC existed
+			namespaceLabels = getClaimMetadata(persV).NamespaceLabels
+		}
+		if selector.Matches(labels.Set(namespaceLabels)) {
+			return fmt.Sprintf("namespace %s matches %s", namespaceName, *approvalNamespaceSelector), nil
+		}
+	}
+	return "", nil
+}
+
+// Deletion guard: blocks the deletion of PVs requiring an approval until they have one. The first time, the PV is marked
+// as awaiting approval and admins are notified.
+func approvalGuard(persV v1.PersistentVolume, trigger string) string {
+	why, err := approvalRequiredFor(persV)
+	if err != nil {
+		// be conservative: if we cannot tell, require an approval
+		why = err.Error()
+	}
+	if why == "" {
+		return ""
+	}
+	if approvedBy := persV.ObjectMeta.Annotations[annotationApprovedBy]; approvedBy != "" {
+		klog.Infof("INFO: deletion of PV %s (%s) was approved by %s", persV.Name, why, approvedBy)
+		return ""
+	}
+	if _, ok := persV.ObjectMeta.Annotations[annotationAwaitingApproval]; !ok {
+		klog.Infof("INFO: deletion of PV %s is due but needs an approval: %s", persV.Name, why)
+		setPVAnnotations(persV.Name, map[string]string{annotationAwaitingApproval: time.Now().Format(time.RFC3339)})
+		queueNotification(persV, notificationApprovalRequired, persV.ObjectMeta.Annotations[annotationDelete])
+	}
+	return fmt.Sprintf("awaiting deletion approval (%s), approve with `approve %s`", why, persV.Name)
+}
+
+// approve command: records who approved the deletion of a PV. The approver is the user the command is authenticated as,
+// which must not be a serviceaccount of the reclaimer (e.g. when run with `oc exec` in its pod).
+func runApprove(args []string) {
+	if len(args) != 1 {
+		klog.Fatalf("ERROR: usage: approve <pv> [-approvalReason=<reason>]")
+	}
+	approver, err := authenticatedUser()
+	if err != nil {
+		klog.Fatalf("ERROR: cannot tell who approves - %v", err)
+	}
+	if strings.HasPrefix(approver, "system:serviceaccount:"+currentNamespace()+":") {
+		klog.Fatalf("ERROR: authenticated as %s, the serviceaccount of the reclaimer: run the command with your own credentials (-kubeconfig)", approver)
+	}
+	persV, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Get(args[0], meta_v1.GetOptions{})
+	if err != nil {
+		klog.Fatalf("ERROR: getting PV %s - %v", args[0], err)
+	}
+	if persV.Status.Phase != v1.VolumeReleased {
+		klog.Warningf("WARNING: PV %s is %s, the approval will only be used once it is Released", persV.Name, persV.Status.Phase)
+	}
+	if _, ok := persV.ObjectMeta.Annotations[annotationAwaitingApproval]; !ok {
+		klog.Warningf("WARNING: PV %s is not awaiting a deletion approval", persV.Name)
+	}
+
+	approvedAt := time.Now().Format(time.RFC3339)
+	if err := setPVAnnotations(persV.Name, map[string]string{annotationApprovedBy: approver, annotationApprovedAt: approvedAt}); err != nil {
+		klog.Fatalf("ERROR: recording the approval on PV %s - %v", persV.Name, err)
+	}
+	recordAudit(*persV, auditDeletionApproved, *approvalReason, map[string]string{annotationApprovedBy: approver, annotationApprovedAt: approvedAt})
+	fmt.Printf("Deletion of PV %s approved by %s, it can be deleted from the next run on\n", persV.Name, approver)
+}
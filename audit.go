@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Version of the reclaimer recorded in the audit entries, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Actions recorded in the audit trail
+const (
+	auditDeletionTimestampSet = "deletion-timestamp-set"
+	auditReclaimPolicySet     = "reclaim-policy-set"
+	auditRetentionExtended    = "retention-extended"
+	auditRestored             = "restored"
+)
+
+var (
+	auditSinkType      = flag.String("auditSink", "", "where to record the audit trail of all actions on PVs: file, configmap or http. No audit trail if empty")
+	auditFile          = flag.String("auditFile", "/var/log/reclaim-volumes/audit.log", "with -auditSink=file, append-only file of the audit entries (one JSON document per line)")
+	auditConfigMap     = flag.String("auditConfigMap", "reclaim-volumes-audit", "with -auditSink=configmap, ConfigMap in the namespace of the reclaimer keeping the last audit entries")
+	auditConfigMapSize = flag.Int("auditConfigMapSize", 1000, "with -auditSink=configmap, number of audit entries kept")
+	auditURL           = flag.String("auditURL", "", "with -auditSink=http, endpoint the audit entries are POSTed to. History is queried with GET <auditURL>?persistentVolume=<pv>")
+)
+
+// One action of the reclaimer on a PV, with everything needed to explain it later
+type auditEntry struct {
+	Timestamp        time.Time `json:"timestamp"`
+	Action           string    `json:"action"`
+	PersistentVolume string    `json:"persistentVolume"`
+	ClaimNamespace   string    `json:"claimNamespace,omitempty"`
+	ClaimName        string    `json:"claimName,omitempty"`
+	Capacity         string    `json:"capacity,omitempty"`
+	// the annotations and settings the decision was based on
+	PolicyInputs map[string]string `json:"policyInputs,omitempty"`
+	// what was changed, e.g. the new deletion timestamp
+	Details map[string]string `json:"details,omitempty"`
+	Reason  string            `json:"reason"`
+	Version string            `json:"version"`
+	// tamper evidence, see audit_chain.go
+	Sequence     int64  `json:"sequence"`
+	PreviousHash string `json:"previousHash,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+	Signature    string `json:"signature,omitempty"`
+}
+
+// Where audit entries are stored and queried from
+type auditSink interface {
+	record(entry auditEntry) error
+	history(pvName string) ([]auditEntry, error)
+}
+
+// Sinks keeping the whole trail themselves chain the entries, see audit_chain.go. Several processes write to them (the
+// reclaimer and the commands run next to it), so the last entry is read again for every new one.
+type chainedAuditSink interface {
+	auditSink
+	// all the entries, in the order they were recorded
+	entries() ([]auditEntry, error)
+	// appends the entries returned by next for the current last entry (zero if there is none), atomically: next is
+	// called again if another process appended in the meantime
+	appendChained(next func(last auditEntry) []auditEntry) error
+}
+
+var (
+	configuredAuditSink auditSink
+	auditSinkConfigured bool
+)
+
+// Returns the sink selected on the command line, nil if there is no audit trail
+func getAuditSink() auditSink {
+	if !auditSinkConfigured {
+		auditSinkConfigured = true
+		switch *auditSinkType {
+		case "":
+		case "file":
+			configuredAuditSink = &fileAuditSink{path: *auditFile}
+		case "configmap":
+			configuredAuditSink = &configMapAuditSink{namespace: currentNamespace(), name: *auditConfigMap, size: *auditConfigMapSize}
+		case "http":
+			configuredAuditSink = &httpAuditSink{url: *auditURL, client: &http.Client{Timeout: 30 * time.Second}}
+		default:
+			klog.Fatalf("ERROR: unknown audit sink '%s'", *auditSinkType)
+		}
+	}
+	return configuredAuditSink
+}
+
+// Records an action performed on a PV. Failing to record is logged but does not prevent the action.
+func recordAudit(persV v1.PersistentVolume, action, reason string, details map[string]string) {
+	sink := getAuditSink()
+	if sink == nil {
+		return
+	}
+	entry := auditEntry{
+		Timestamp:        time.Now().UTC(),
+		Action:           action,
+		PersistentVolume: persV.Name,
+		PolicyInputs: map[string]string{
+			"reclaimPolicy":     string(persV.Spec.PersistentVolumeReclaimPolicy),
+			"phase":             string(persV.Status.Phase),
+			"creationTimestamp": persV.CreationTimestamp.UTC().Format(time.RFC3339),
+		},
+		Details: details,
+		Reason:  reason,
+		Version: version,
+	}
+	for _, key := range []string{annotationPeriodReclaimVolumesAfterRelease, annotationNoGracePeriodSinceCreation, annotationDelete, annotationRetentionExtendedBy} {
+		if value, ok := persV.ObjectMeta.Annotations[key]; ok {
+			entry.PolicyInputs[key] = value
+		}
+	}
+	if claimRef := userClaimRef(persV); claimRef != nil {
+		entry.ClaimNamespace = claimRef.Namespace
+		entry.ClaimName = claimRef.Name
+	}
+	if capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]; ok {
+		entry.Capacity = capacity.String()
+	}
+
+	if err := sink.record(entry); err != nil {
+		klog.Errorf("ERROR: recording audit entry %s for PV %s - %v", action, persV.Name, err)
+	}
+}
+
+// history command: prints the audit entries of a PV
+func runHistory(args []string) {
+	if len(args) != 1 {
+		klog.Fatalf("ERROR: usage: history <pv>")
+	}
+	sink := getAuditSink()
+	if sink == nil {
+		klog.Fatalf("ERROR: no audit sink configured, use -auditSink")
+	}
+	entries, err := sink.history(args[0])
+	if err != nil {
+		klog.Fatalf("ERROR: reading the audit trail - %v", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIMESTAMP\tACTION\tCLAIM\tCAPACITY\tDETAILS\tREASON\tVERSION")
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s\t%s\t%s/%s\t%s\t%v\t%s\t%s\n", entry.Timestamp.Format(time.RFC3339), entry.Action,
+			entry.ClaimNamespace, entry.ClaimName, entry.Capacity, entry.Details, entry.Reason, entry.Version)
+	}
+	writer.Flush()
+}
+
+// Appends one JSON document per line to a local file (typically on a persistent volume)
+type fileAuditSink struct {
+	path string
+}
+
+// Longest line of the audit file
+const maxAuditEntrySize = 1024 * 1024
+
+func (sink *fileAuditSink) record(entry auditEntry) error {
+	return recordChainedAudit(sink, entry)
+}
+
+func (sink *fileAuditSink) appendChained(next func(last auditEntry) []auditEntry) error {
+	file, err := os.OpenFile(sink.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// the commands run in the reclaimer pod (approve, inspect) append to the same file
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	last, err := lastFileAuditEntry(file)
+	if err != nil {
+		return fmt.Errorf("cannot read the last audit entry to chain to - %v", err)
+	}
+	lines := []byte{}
+	for _, entry := range next(last) {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	_, err = file.Write(lines)
+	return err
+}
+
+// The last line of the file, without reading it all
+func lastFileAuditEntry(file *os.File) (auditEntry, error) {
+	entry := auditEntry{}
+	info, err := file.Stat()
+	if err != nil {
+		return entry, err
+	}
+	offset := info.Size() - maxAuditEntrySize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return entry, err
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return entry, nil
+	}
+	return entry, json.Unmarshal(tail[bytes.LastIndexByte(tail, '\n')+1:], &entry)
+}
+
+func (sink *fileAuditSink) entries() ([]auditEntry, error) {
+	file, err := os.Open(sink.path)
+	if os.IsNotExist(err) {
+		// nothing recorded yet
+		return []auditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []auditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxAuditEntrySize)
+	for scanner.Scan() {
+		entry := auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+func (sink *fileAuditSink) history(pvName string) ([]auditEntry, error) {
+	entries, err := sink.entries()
+	if err != nil {
+		return nil, err
+	}
+	return auditEntriesOf(entries, pvName), nil
+}
+
+// Keeps the last entries in a ConfigMap, the oldest ones are dropped
+type configMapAuditSink struct {
+	namespace string
+	name      string
+	size      int
+}
+
+func (sink *configMapAuditSink) load() (*v1.ConfigMap, []auditEntry, error) {
+	configMap, err := kubeclient.kubeclient.CoreV1().ConfigMaps(sink.namespace).Get(sink.name, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		return nil, []auditEntry{}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := []auditEntry{}
+	if value := configMap.Data["entries"]; value != "" {
+		if err := json.Unmarshal([]byte(value), &entries); err != nil {
+			return nil, nil, err
+		}
+	}
+	return configMap, entries, nil
+}
+
+func (sink *configMapAuditSink) record(entry auditEntry) error {
+	return recordChainedAudit(sink, entry)
+}
+
+func (sink *configMapAuditSink) appendChained(next func(last auditEntry) []auditEntry) error {
+	// retry, chaining to the new last entry, if someone else updated the ConfigMap in the meantime
+	var err error
+	for attempt := 0; attempt < 5; attempt++ {
+		if err = sink.append(next); !api_errors.IsConflict(err) && !api_errors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (sink *configMapAuditSink) append(next func(last auditEntry) []auditEntry) error {
+	configMap, entries, err := sink.load()
+	if err != nil {
+		return err
+	}
+	last := auditEntry{}
+	if len(entries) > 0 {
+		last = entries[len(entries)-1]
+	}
+	entries = append(entries, next(last)...)
+	if len(entries) > sink.size {
+		entries = entries[len(entries)-sink.size:]
+	}
+	value, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if configMap == nil {
+		configMap = &v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: sink.name, Labels: map[string]string{managedByLabel: managedByValue}}}
+		configMap.Data = map[string]string{"entries": string(value)}
+		_, err = kubeclient.kubeclient.CoreV1().ConfigMaps(sink.namespace).Create(configMap)
+		return err
+	}
+	configMap.Data = map[string]string{"entries": string(value)}
+	_, err = kubeclient.kubeclient.CoreV1().ConfigMaps(sink.namespace).Update(configMap)
+	return err
+}
+
+func (sink *configMapAuditSink) entries() ([]auditEntry, error) {
+	_, entries, err := sink.load()
+	return entries, err
+}
+
+func (sink *configMapAuditSink) history(pvName string) ([]auditEntry, error) {
+	entries, err := sink.entries()
+	if err != nil {
+		return nil, err
+	}
+	return auditEntriesOf(entries, pvName), nil
+}
+
+func auditEntriesOf(entries []auditEntry, pvName string) []auditEntry {
+	selected := []auditEntry{}
+	for _, entry := range entries {
+		if entry.PersistentVolume == pvName {
+			selected = append(selected, entry)
+		}
+	}
+	return selected
+}
+
+// Sends the entries to an external audit service, which keeps the trail and is responsible for its integrity
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (sink *httpAuditSink) record(entry auditEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	resp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (sink *httpAuditSink) history(pvName string) ([]auditEntry, error) {
+	resp, err := sink.client.Get(sink.url + "?persistentVolume=" + url.QueryEscape(pvName))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("audit endpoint returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	entries := []auditEntry{}
+	return entries, json.Unmarshal(body, &entries)
+}
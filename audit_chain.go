@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// To show that audit entries (in particular deletions) were not edited after the fact, each entry records the hash of the
+// previous one and its own hash, and after every auditCheckpointInterval entries a checkpoint entry signs the current hash
+// with a key only the reclaimer can read. The hashes alone can be recomputed by anyone rewriting the trail: the checkpoints
+// are expected at fixed positions, so that they cannot be dropped either. The http sink is not chained: the audit service
+// keeps the trail.
+
+// Action of the checkpoint entries
+const auditCheckpoint = "checkpoint"
+
+var (
+	auditSigningSecret      = flag.String("auditSigningSecret", "", "Secret, in the namespace of the reclaimer, with the key used to sign audit checkpoints (data key 'key'). No checkpoints if empty")
+	auditCheckpointInterval = flag.Int64("auditCheckpointInterval", 100, "write a signed checkpoint in the audit trail every this many entries")
+)
+
+var (
+	auditSigningKey []byte
+	auditKeyLoaded  bool
+)
+
+// Hash of an entry: SHA-256 of its JSON representation without the hash and signature
+func hashAuditEntry(entry auditEntry) string {
+	entry.Hash = ""
+	entry.Signature = ""
+	content, _ := json.Marshal(entry)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func signAuditHash(key []byte, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reads the signing key from its Secret, once
+func getAuditSigningKey() []byte {
+	if !auditKeyLoaded {
+		auditKeyLoaded = true
+		if *auditSigningSecret != "" {
+			secret, err := kubeclient.kubeclient.CoreV1().Secrets(currentNamespace()).Get(*auditSigningSecret, meta_v1.GetOptions{})
+			if err != nil {
+				klog.Errorf("ERROR: reading audit signing key from Secret %s - %v", *auditSigningSecret, err)
+			} else if len(secret.Data["key"]) == 0 {
+				klog.Errorf("ERROR: Secret %s has no 'key' to sign audit checkpoints", *auditSigningSecret)
+			} else {
+				auditSigningKey = secret.Data["key"]
+			}
+		}
+	}
+	return auditSigningKey
+}
+
+// Records the entry linked to the last one of the chain, and a signed checkpoint when it is time to. A process that
+// should sign checkpoints but could not read the key does not record anything in the place of a checkpoint: verify-audit
+// would report it as removed.
+func recordChainedAudit(sink chainedAuditSink, entry auditEntry) error {
+	key := getAuditSigningKey()
+	var refused error
+	err := sink.appendChained(func(last auditEntry) []auditEntry {
+		if key == nil && *auditSigningSecret != "" && auditCheckpointDue(last.Sequence+1, *auditCheckpointInterval) {
+			refused = fmt.Errorf("a signed checkpoint is due as entry #%d, but the key of Secret %s could not be read", last.Sequence+1, *auditSigningSecret)
+			return nil
+		}
+		return chainAuditEntries(last, entry, key, *auditCheckpointInterval)
+	})
+	if err != nil {
+		return err
+	}
+	return refused
+}
+
+// Whether the entry at this position of the chain is a checkpoint: every interval+1 entries, i.e. after interval entries
+func auditCheckpointDue(sequence, interval int64) bool {
+	return interval > 0 && sequence%(interval+1) == 0
+}
+
+// The entries to append after last for a new entry: the entry linked to last, and the checkpoints due before and after
+// it. No checkpoints without key.
+func chainAuditEntries(last, entry auditEntry, key []byte, interval int64) []auditEntry {
+	chained := []auditEntry{}
+	link := func(next auditEntry) {
+		next.Sequence = last.Sequence + 1
+		next.PreviousHash = last.Hash
+		next.Hash = hashAuditEntry(next)
+		if next.Action == auditCheckpoint {
+			next.Signature = signAuditHash(key, next.Hash)
+		}
+		chained = append(chained, next)
+		last = next
+	}
+	checkpoint := func() {
+		if key == nil || !auditCheckpointDue(last.Sequence+1, interval) {
+			return
+		}
+		link(auditEntry{
+			Timestamp: entry.Timestamp,
+			Action:    auditCheckpoint,
+			Reason:    fmt.Sprintf("signed checkpoint of the %d first entries", last.Sequence),
+			Version:   version,
+		})
+	}
+	// left out by a process without the key
+	checkpoint()
+	link(entry)
+	checkpoint()
+	return chained
+}
+
+// verify-audit command: checks the whole chain and reports gaps, modified entries and invalid checkpoints.
+// Exits with an error if anything is wrong.
+func runVerifyAudit(args []string) {
+	sink, ok := getAuditSink().(chainedAuditSink)
+	if !ok {
+		klog.Fatalf("ERROR: verify-audit needs -auditSink=file or -auditSink=configmap")
+	}
+	entries, err := sink.entries()
+	if err != nil {
+		klog.Fatalf("ERROR: reading the audit trail - %v", err)
+	}
+	key := getAuditSigningKey()
+
+	problems := verifyAuditChain(entries, key, *auditCheckpointInterval)
+	checkpoints := 0
+	for _, entry := range entries {
+		if entry.Action == auditCheckpoint {
+			checkpoints++
+		}
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d entries, %d checkpoints, %d problem(s)\n", len(entries), checkpoints, len(problems))
+	if key == nil {
+		fmt.Println("checkpoint signatures were not verified: no -auditSigningSecret")
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// The problems found in the chain. Without key, the checkpoints are not checked: anyone can recompute the hashes of a
+// rewritten trail, only the signed checkpoints at their expected positions show it was not.
+func verifyAuditChain(entries []auditEntry, key []byte, interval int64) []string {
+	problems := []string{}
+	lastSigned := int64(0)
+	for i, entry := range entries {
+		if entry.Hash == "" {
+			problems = append(problems, fmt.Sprintf("entry %d (%s %s at %v) is not chained", i, entry.Action, entry.PersistentVolume, entry.Timestamp))
+			continue
+		}
+		if hashAuditEntry(entry) != entry.Hash {
+			problems = append(problems, fmt.Sprintf("entry #%d (%s %s) was modified: its hash does not match its content", entry.Sequence, entry.Action, entry.PersistentVolume))
+		}
+		if i == 0 {
+			if entry.Sequence != 1 {
+				// expected with the configmap sink, which drops the oldest entries
+				fmt.Printf("the audit trail starts at entry #%d, older entries are not available\n", entry.Sequence)
+				lastSigned = entry.Sequence - 1
+			}
+		} else {
+			previous := entries[i-1]
+			if entry.Sequence != previous.Sequence+1 {
+				problems = append(problems, fmt.Sprintf("gap: entries #%d to #%d are missing", previous.Sequence+1, entry.Sequence-1))
+			}
+			if entry.PreviousHash != previous.Hash {
+				problems = append(problems, fmt.Sprintf("entry #%d does not follow entry #%d: the previous entry was removed or modified", entry.Sequence, previous.Sequence))
+			}
+		}
+		if key == nil {
+			continue
+		}
+		if entry.Action == auditCheckpoint {
+			if !hmac.Equal([]byte(signAuditHash(key, entry.Hash)), []byte(entry.Signature)) {
+				problems = append(problems, fmt.Sprintf("checkpoint #%d has an invalid signature", entry.Sequence))
+			} else {
+				lastSigned = entry.Sequence
+			}
+		} else if auditCheckpointDue(entry.Sequence, interval) {
+			problems = append(problems, fmt.Sprintf("entry #%d should be a signed checkpoint: checkpoints were removed", entry.Sequence))
+		}
+	}
+	if len(entries) > 0 && key != nil && interval > 0 {
+		if last := entries[len(entries)-1]; last.Sequence-lastSigned > interval {
+			problems = append(problems, fmt.Sprintf("%d entries after the last signed checkpoint #%d, at most %d expected", last.Sequence-lastSigned, lastSigned, interval))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAuditKey = []byte("test-key")
+
+// A trail of count entries (checkpoints included) as recorded with this key and checkpoint interval
+func testAuditTrail(count int, key []byte, interval int64) []auditEntry {
+	entries := []auditEntry{}
+	last := auditEntry{}
+	for i := 0; len(entries) < count; i++ {
+		entry := auditEntry{Timestamp: time.Date(2020, 1, 1, 0, i, 0, 0, time.UTC), Action: auditDeletionTimestampSet, PersistentVolume: "pv-test"}
+		for _, chained := range chainAuditEntries(last, entry, key, interval) {
+			if len(entries) < count {
+				entries = append(entries, chained)
+				last = chained
+			}
+		}
+	}
+	return entries
+}
+
+func TestChainAuditEntriesCheckpoints(t *testing.T) {
+	entries := testAuditTrail(25, testAuditKey, 5)
+	for _, entry := range entries {
+		isCheckpoint := entry.Action == auditCheckpoint
+		if isCheckpoint != (entry.Sequence%6 == 0) {
+			t.Errorf("entry #%d: checkpoint is %v", entry.Sequence, isCheckpoint)
+		}
+	}
+	if problems := verifyAuditChain(entries, testAuditKey, 5); len(problems) != 0 {
+		t.Errorf("valid trail reported as %v", problems)
+	}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	cases := []struct {
+		name    string
+		tamper  func([]auditEntry) []auditEntry
+		problem string
+	}{
+		{"modified entry", func(entries []auditEntry) []auditEntry {
+			entries[3].PersistentVolume = "pv-other"
+			return entries
+		}, "entry #4 (deletion-timestamp-set pv-other) was modified"},
+		{"removed entry", func(entries []auditEntry) []auditEntry {
+			return append(entries[:3], entries[4:]...)
+		}, "gap: entries #4 to #4 are missing"},
+		{"rehashed entry", func(entries []auditEntry) []auditEntry {
+			entries[3].PersistentVolume = "pv-other"
+			entries[3].Hash = hashAuditEntry(entries[3])
+			return entries
+		}, "entry #5 does not follow entry #4"},
+		{"invalid signature", func(entries []auditEntry) []auditEntry {
+			entries[5].Signature = "0000"
+			return entries
+		}, "checkpoint #6 has an invalid signature"},
+		{"removed checkpoints, rehashed trail", func(entries []auditEntry) []auditEntry {
+			rewritten := []auditEntry{}
+			last := auditEntry{}
+			for _, entry := range entries {
+				if entry.Action == auditCheckpoint {
+					continue
+				}
+				rewritten = append(rewritten, chainAuditEntries(last, entry, nil, 5)...)
+				last = rewritten[len(rewritten)-1]
+			}
+			return rewritten
+		}, "entry #6 should be a signed checkpoint"},
+		{"rewritten tail without checkpoints", func(entries []auditEntry) []auditEntry {
+			rewritten := entries[:7]
+			last := rewritten[6]
+			for i := 0; i < 5; i++ {
+				chained := chainAuditEntries(last, auditEntry{Action: auditDeletionTimestampSet}, nil, 0)
+				rewritten = append(rewritten, chained...)
+				last = chained[0]
+			}
+			return rewritten
+		}, "6 entries after the last signed checkpoint #6"},
+	}
+	for _, c := range cases {
+		problems := verifyAuditChain(c.tamper(testAuditTrail(20, testAuditKey, 5)), testAuditKey, 5)
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, c.problem)
+		}
+		if !found {
+			t.Errorf("%s: expected '%s', got %v", c.name, c.problem, problems)
+		}
+	}
+}
+
+func TestVerifyAuditChainWithoutKey(t *testing.T) {
+	entries := testAuditTrail(20, nil, 5)
+	if problems := verifyAuditChain(entries, nil, 5); len(problems) != 0 {
+		t.Errorf("valid trail reported as %v", problems)
+	}
+	// checkpoints are needed once the signing key is used
+	if problems := verifyAuditChain(entries, testAuditKey, 5); len(problems) == 0 {
+		t.Errorf("trail without checkpoints not reported")
+	}
+}
+
+func TestFileAuditSinkChaining(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink := &fileAuditSink{path: filepath.Join(dir, "audit.log")}
+
+	// nothing recorded yet
+	if entries, err := sink.entries(); err != nil || len(entries) != 0 {
+		t.Fatalf("entries of a new trail: %v, %v", entries, err)
+	}
+	for i := 0; i < 12; i++ {
+		next := func(last auditEntry) []auditEntry {
+			return chainAuditEntries(last, auditEntry{Action: auditDeletionTimestampSet, PersistentVolume: "pv-test"}, testAuditKey, 5)
+		}
+		if err := sink.appendChained(next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := sink.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 14 {
+		t.Errorf("expected 12 entries and 2 checkpoints, got %d", len(entries))
+	}
+	if problems := verifyAuditChain(entries, testAuditKey, 5); len(problems) != 0 {
+		t.Errorf("trail reported as %v", problems)
+	}
+}
+
+func TestRecordChainedAuditWithoutKeyLeavesCheckpointsFree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sink := &fileAuditSink{path: filepath.Join(dir, "audit.log")}
+	*auditSigningSecret, *auditCheckpointInterval = "audit-key", 5
+	auditSigningKey, auditKeyLoaded = nil, true
+	defer func() {
+		*auditSigningSecret, *auditCheckpointInterval = "", 100
+		auditKeyLoaded = false
+	}()
+
+	for i := 1; i <= 6; i++ {
+		err := recordChainedAudit(sink, auditEntry{Action: auditDeletionTimestampSet, PersistentVolume: "pv-test"})
+		// entry #6 must be a checkpoint
+		if (err != nil) != (i == 6) {
+			t.Errorf("entry %d: error is %v", i, err)
+		}
+	}
+	entries, err := sink.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Errorf("%d entries recorded, expected 5", len(entries))
+	}
+}
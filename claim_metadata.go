@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"reflect"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+)
+
+// Metadata of the PVC and its namespace, copied to the PV while it is bound since both may be gone once it is Released
+const annotationClaimMetadata = "reclaim-volumes.cern.ch/claim-metadata"
+
+var (
+	captureClaimLabels          = flag.String("captureClaimLabels", "", "comma-separated list of PVC labels copied to the PV before the PVC is deleted (controller mode)")
+	captureClaimAnnotations     = flag.String("captureClaimAnnotations", "", "comma-separated list of PVC annotations copied to the PV before the PVC is deleted (controller mode)")
+	captureNamespaceLabels      = flag.String("captureNamespaceLabels", "", "comma-separated list of namespace labels copied to the PV before the PVC is deleted (controller mode)")
+	captureNamespaceAnnotations = flag.String("captureNamespaceAnnotations", "openshift.io/requester", "comma-separated list of namespace annotations copied to the PV before the PVC is deleted (controller mode)")
+)
+
+// Stored as JSON in the annotationClaimMetadata annotation of the PV
+type claimMetadata struct {
+	ClaimLabels          map[string]string `json:"claimLabels,omitempty"`
+	ClaimAnnotations     map[string]string `json:"claimAnnotations,omitempty"`
+	NamespaceLabels      map[string]string `json:"namespaceLabels,omitempty"`
+	NamespaceAnnotations map[string]string `json:"namespaceAnnotations,omitempty"`
+	// kind/name of the controller of the PVC (e.g. StatefulSet/db), to recognize PVCs created in a loop
+	ClaimOwner string `json:"claimOwner,omitempty"`
+}
+
+// Splits a comma-separated flag value, ignoring empty items
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func stringInList(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Keeps only the given keys of a map
+func selectKeys(values map[string]string, keys []string) map[string]string {
+	selected := map[string]string{}
+	for _, key := range keys {
+		if value, ok := values[key]; ok {
+			selected[key] = value
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	return selected
+}
+
+// Namespaces of the cluster, listed once per pass when first needed
+var (
+	namespaces       map[string]v1.Namespace
+	namespacesListed bool
+)
+
+func resetNamespaces() {
+	namespaces = nil
+	namespacesListed = false
+}
+
+// Returns a namespace from the list of the current pass, and whether it exists
+func getNamespace(name string) (v1.Namespace, bool, error) {
+	if !namespacesListed {
+		namespaceList, err := kubeclient.kubeclient.CoreV1().Namespaces().List(meta_v1.ListOptions{})
+		if err != nil {
+			return v1.Namespace{}, false, err
+		}
+		namespaces = map[string]v1.Namespace{}
+		for _, namespace := range namespaceList.Items {
+			namespaces[namespace.Name] = namespace
+		}
+		namespacesListed = true
+	}
+	namespace, ok := namespaces[name]
+	return namespace, ok, nil
+}
+
+// Returns the metadata captured on the PV. Empty if nothing was captured.
+func getClaimMetadata(persV v1.PersistentVolume) claimMetadata {
+	metadata := claimMetadata{}
+	if value, ok := persV.ObjectMeta.Annotations[annotationClaimMetadata]; ok {
+		if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+			klog.Errorf("ERROR: invalid annotation %s on PV %s - %v", annotationClaimMetadata, persV.Name, err)
+		}
+	}
+	return metadata
+}
+
+// Copies the selected metadata of the PVC and of its namespace (nil if unknown) to the PV, if they changed
+func captureClaimMetadata(persV v1.PersistentVolume, pvc v1.PersistentVolumeClaim, namespace *v1.Namespace) {
+	metadata := getClaimMetadata(persV)
+	metadata.ClaimLabels = selectKeys(pvc.Labels, splitList(*captureClaimLabels))
+	metadata.ClaimAnnotations = selectKeys(pvc.Annotations, splitList(*captureClaimAnnotations))
+	if owner := meta_v1.GetControllerOf(&pvc); owner != nil {
+		metadata.ClaimOwner = owner.Kind + "/" + owner.Name
+	}
+
+	// the namespace might already be terminating (or gone), keep what we captured before in that case
+	if namespace != nil {
+		metadata.NamespaceLabels = selectKeys(namespace.Labels, splitList(*captureNamespaceLabels))
+		metadata.NamespaceAnnotations = selectKeys(namespace.Annotations, splitList(*captureNamespaceAnnotations))
+	}
+
+	if _, ok := persV.ObjectMeta.Annotations[annotationClaimMetadata]; ok && reflect.DeepEqual(metadata, getClaimMetadata(persV)) {
+		return
+	}
+	value, err := json.Marshal(metadata)
+	if err != nil {
+		return
+	}
+	klog.V(2).Infof("capturing metadata of PVC %s/%s on PV %s", pvc.Namespace, pvc.Name, persV.Name)
+	setPVAnnotations(persV.Name, map[string]string{annotationClaimMetadata: string(value)})
+}
+
+// Captures the metadata of all Bound PVs. This makes sure we have it even if we missed the deletion of the PVC
+// (e.g. the controller was not running).
+func captureBoundClaimsMetadata() error {
+	pvList, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	pvcList, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims("").List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	pvcs := map[string]v1.PersistentVolumeClaim{}
+	for _, pvc := range pvcList.Items {
+		pvcs[pvc.Namespace+"/"+pvc.Name] = pvc
+	}
+	resetNamespaces()
+
+	for _, persV := range pvList.Items {
+		if persV.Status.Phase != v1.VolumeBound || persV.Spec.ClaimRef == nil {
+			continue
+		}
+		pvc, ok := pvcs[persV.Spec.ClaimRef.Namespace+"/"+persV.Spec.ClaimRef.Name]
+		if !ok || pvc.UID != persV.Spec.ClaimRef.UID {
+			continue
+		}
+		namespace, found, err := getNamespace(pvc.Namespace)
+		if err != nil {
+			return err
+		}
+		if found {
+			captureClaimMetadata(persV, pvc, &namespace)
+		} else {
+			captureClaimMetadata(persV, pvc, nil)
+		}
+	}
+	return nil
+}
+
+// Watches PVCs and captures their metadata on their PV as soon as they are being deleted, so we get the latest values
+// while the PVC (kept by its protection finalizer while in use) and its namespace still exist.
+func watchClaimDeletions() {
+	for {
+		watcher, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims("").Watch(meta_v1.ListOptions{})
+		if err != nil {
+			klog.Errorf("ERROR: watching PVCs - %v", err)
+			time.Sleep(*resyncPeriod)
+			continue
+		}
+		for event := range watcher.ResultChan() {
+			pvc, ok := event.Object.(*v1.PersistentVolumeClaim)
+			if !ok || pvc.Spec.VolumeName == "" {
+				continue
+			}
+			if event.Type == watch.Deleted || (event.Type == watch.Modified && pvc.DeletionTimestamp != nil) {
+				persV, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, meta_v1.GetOptions{})
+				if err != nil || persV.Spec.ClaimRef == nil || persV.Spec.ClaimRef.UID != pvc.UID {
+					continue
+				}
+				namespace, err := kubeclient.kubeclient.CoreV1().Namespaces().Get(pvc.Namespace, meta_v1.GetOptions{})
+				if err != nil {
+					namespace = nil
+				}
+				captureClaimMetadata(*persV, *pvc, namespace)
+			}
+		}
+		// the API server closes watches after a while, just start a new one
+		watcher.Stop()
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"k8s.io/klog"
+)
+
+var resyncPeriod = flag.Duration("resyncPeriod", time.Minute, "in controller mode, how often all PVs and user requests are processed")
+
+// Controller mode: instead of processing all PVs once and exiting (CronJob), keep running and process
+// user requests (e.g. VolumeRestoreRequests) as well as all PVs every resyncPeriod.
+func runController(args []string) {
+	klog.Infof("INFO: starting reclaimer in controller mode, resync period %v", *resyncPeriod)
+
+	go watchClaimDeletions()
+	if *trackMounts {
+		go watchPodMounts()
+	}
+	serveMetrics()
+	publishPausedState()
+
+	for {
+		// Users' requests are processed first, so a PV a user asked to restore or keep is not deleted in the same iteration
+		if err := processRestoreRequests(); err != nil {
+			klog.Errorf("ERROR: processing VolumeRestoreRequests - %v", err)
+		}
+		if err := processRetentionExtensionRequests(); err != nil {
+			klog.Errorf("ERROR: processing VolumeRetentionExtensions - %v", err)
+		}
+
+		if err := captureBoundClaimsMetadata(); err != nil {
+			klog.Errorf("ERROR: capturing metadata of bound PVCs - %v", err)
+		}
+		if err := trackVolumeMounts(); err != nil {
+			klog.Errorf("ERROR: recording the mounts of bound PVs - %v", err)
+		}
+
+		if err := reclaimReleasedVolumes(); err != nil {
+			klog.Errorf("ERROR: Impossible to retrieve the list of all persistent volumes - %v", err)
+		}
+
+		time.Sleep(*resyncPeriod)
+	}
+}
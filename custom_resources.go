@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// API group and version of the custom resources users create to talk to the reclaimer (see chart/crds)
+const (
+	customResourceGroup   = "reclaim-volumes.cern.ch"
+	customResourceVersion = "v1alpha1"
+
+	// phases of the requests, reported in their status
+	requestPhaseInProgress = "InProgress"
+	requestPhaseCompleted  = "Completed"
+	requestPhaseFailed     = "Failed"
+)
+
+// Condition reported in the status of the custom resources, following the usual Kubernetes conventions
+type RequestCondition struct {
+	Type               string       `json:"type"`
+	Status             string       `json:"status"`
+	Reason             string       `json:"reason,omitempty"`
+	Message            string       `json:"message,omitempty"`
+	LastTransitionTime meta_v1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// Adds or updates the condition of the given type. LastTransitionTime only changes when the status changes.
+func setRequestCondition(conditions []RequestCondition, conditionType, status, reason, message string) []RequestCondition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			if conditions[i].Status != status {
+				conditions[i].LastTransitionTime = meta_v1.NewTime(time.Now())
+			}
+			conditions[i].Status = status
+			conditions[i].Reason = reason
+			conditions[i].Message = message
+			return conditions
+		}
+	}
+	return append(conditions, RequestCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: meta_v1.NewTime(time.Now()),
+	})
+}
+
+// We do not have generated clients for our custom resources, so we talk to the API with the REST client of the
+// clientset and (un)marshal the JSON ourselves.
+
+// Lists the custom resources of the given plural name in all namespaces into list
+func listCustomResources(plural string, list interface{}) error {
+	raw, err := kubeclient.kubeclient.CoreV1().RESTClient().Get().
+		AbsPath("/apis", customResourceGroup, customResourceVersion, plural).
+		DoRaw()
+	if api_errors.IsNotFound(err) {
+		// the CRD is not installed in this cluster: there cannot be any request
+		klog.V(2).Infof("custom resource %s.%s is not available in this cluster", plural, customResourceGroup)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, list)
+}
+
+// Replaces the status subresource of a namespaced custom resource
+func updateCustomResourceStatus(plural, namespace, name string, obj interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = kubeclient.kubeclient.CoreV1().RESTClient().Put().
+		AbsPath("/apis", customResourceGroup, customResourceVersion, "namespaces", namespace, plural, name, "status").
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		DoRaw()
+	return err
+}
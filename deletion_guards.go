@@ -0,0 +1,68 @@
+package main
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Why requestPVDeletion is called
+const (
+	deletionTriggerImmediate          = "immediate"
+	deletionTriggerGracePeriodExpired = "grace-period-expired"
+	deletionTriggerPressure           = "storage-pressure"
+)
+
+// Why the deletion of a PV was last blocked ("<guard>: <reason>"), so that it is raised as an event only when it changes
+const annotationDeletionBlocked = "reclaim-volumes.cern.ch/deletion-blocked"
+
+// A check run before the reclaim policy of a PV is set to Delete. It returns why the deletion must not happen now,
+// or an empty string to allow it.
+type deletionGuard struct {
+	name  string
+	check func(persV v1.PersistentVolume, trigger string) string
+}
+
+// All the checks a PV must pass to be deleted, in order
+var deletionGuards = []deletionGuard{
+	{"paused", pauseGuard},
+	{"deletion-schedule", deletionScheduleGuard},
+	{"shared-backend", sharedBackendGuard},
+	{"volume-in-use", volumeInUseGuard},
+	{"approval", approvalGuard},
+	// last, as it starts a Job: only once nothing else blocks the deletion
+	{"pre-delete-hook", preDeleteHookGuard},
+}
+
+// Runs the deletion guards. A blocked deletion is logged and counted in the metrics, and raised as a Warning event on the
+// PV when it is blocked for a new reason; it will be attempted again at the next run.
+func pvDeletionIsBlocked(persV v1.PersistentVolume, trigger string) bool {
+	lastBlocked, wasBlocked := persV.ObjectMeta.Annotations[annotationDeletionBlocked]
+	for _, guard := range deletionGuards {
+		reason := guard.check(persV, trigger)
+		if reason == "" {
+			continue
+		}
+		klog.Warningf("WARNING: not deleting PV %s (%s): %s", persV.Name, guard.name, reason)
+		if summary.BlockedDeletions == nil {
+			summary.BlockedDeletions = map[string]int{}
+		}
+		summary.BlockedDeletions[guard.name]++
+		if blocked := guard.name + ": " + reason; blocked != lastBlocked {
+			recordPVEvent(persV, v1.EventTypeWarning, "DeletionBlocked", reason)
+			setPVAnnotations(persV.Name, map[string]string{annotationDeletionBlocked: blocked})
+		}
+		return true
+	}
+	if wasBlocked {
+		setPVAnnotations(persV.Name, map[string]string{annotationDeletionBlocked: ""})
+	}
+	return false
+}
+
+func allDeletionGuards() []string {
+	names := []string{}
+	for _, guard := range deletionGuards {
+		names = append(names, guard.name)
+	}
+	return names
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// Volumes must not be deleted when nobody could react to a mistake (outside working hours, during the end-of-year
+// closure) or while the storage is being worked on (Ceph upgrades). Deletions due to an expired grace period are
+// deferred until the schedule allows them again; deletion timestamps keep being set as usual.
+
+var (
+	deletionWindows         = flag.String("deletionWindows", "", "semicolon-separated cron-like expressions (minute hour day-of-month month day-of-week) of the times when PVs whose grace period expired may be deleted, e.g. '* 8-17 * * 1-5'. Any time if empty")
+	deletionFreezes         = flag.String("deletionFreezes", "", "comma-separated periods when PVs whose grace period expired are not deleted, as start/end dates (inclusive) or RFC3339 times, e.g. '2026-12-18/2027-01-05'")
+	deletionHolidayCalendar = flag.String("deletionHolidayCalendar", "", "iCalendar (.ics) file whose events are periods when PVs whose grace period expired are not deleted. Read once at startup")
+	deletionTimezone        = flag.String("deletionTimezone", "UTC", "time zone of -deletionWindows, of the dates of -deletionFreezes and of the floating times of -deletionHolidayCalendar")
+)
+
+// A cron-like expression: the minutes it matches are the ones when deletions are allowed
+type deletionWindow struct {
+	expression                          string
+	minutes, hours, days, months, wdays []bool
+	// as in cron, when both day of month and day of week are restricted, a day matching either is allowed
+	daysRestricted, wdaysRestricted bool
+}
+
+// A period when deletions are not allowed
+type deletionFreeze struct {
+	start, end time.Time
+	reason     string
+}
+
+type deletionScheduleConfig struct {
+	location *time.Location
+	windows  []deletionWindow
+	freezes  []deletionFreeze
+}
+
+// Loaded on first use; a configuration that cannot be loaded blocks all the deletions it should apply to
+var (
+	deletionSchedule       *deletionScheduleConfig
+	deletionScheduleErr    error
+	deletionScheduleLoaded bool
+)
+
+// The last decision, reused for all the PVs processed within the same minute
+var (
+	deletionScheduleCheckedAt time.Time
+	deletionScheduleReason    string
+)
+
+// Parses one field of a cron expression: '*', numbers, ranges 'a-b', steps '/n' and lists separated by ','
+func parseCronField(field string, min, max int) ([]bool, error) {
+	allowed := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:i]
+		}
+		first, last := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if first, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", part)
+			}
+			last = first
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range '%s'", part)
+				}
+			} else if step > 1 {
+				last = max
+			}
+		}
+		if first < min || last > max || first > last {
+			return nil, fmt.Errorf("'%s' is not within %d-%d", part, min, max)
+		}
+		for value := first; value <= last; value += step {
+			allowed[value] = true
+		}
+	}
+	return allowed, nil
+}
+
+func parseDeletionWindow(expression string) (deletionWindow, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return deletionWindow{}, fmt.Errorf("deletion window '%s' must have 5 fields (minute hour day-of-month month day-of-week)", expression)
+	}
+	window := deletionWindow{expression: expression, daysRestricted: fields[2] != "*", wdaysRestricted: fields[4] != "*"}
+	var err error
+	if window.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return window, fmt.Errorf("deletion window '%s': minute %v", expression, err)
+	}
+	if window.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return window, fmt.Errorf("deletion window '%s': hour %v", expression, err)
+	}
+	if window.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return window, fmt.Errorf("deletion window '%s': day of month %v", expression, err)
+	}
+	if window.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return window, fmt.Errorf("deletion window '%s': month %v", expression, err)
+	}
+	// 0 and 7 are both Sunday
+	if window.wdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return window, fmt.Errorf("deletion window '%s': day of week %v", expression, err)
+	}
+	window.wdays[0] = window.wdays[0] || window.wdays[7]
+	return window, nil
+}
+
+func (window deletionWindow) allows(t time.Time) bool {
+	if !window.minutes[t.Minute()] || !window.hours[t.Hour()] || !window.months[int(t.Month())] {
+		return false
+	}
+	day, wday := window.days[t.Day()], window.wdays[int(t.Weekday())]
+	if window.daysRestricted && window.wdaysRestricted {
+		return day || wday
+	}
+	return day && wday
+}
+
+// Parses a date (the whole day, in the given location) or an RFC3339 time. The end of a date is the end of that day.
+func parseFreezeBound(value string, location *time.Location, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, location)
+	if err != nil {
+		return t, fmt.Errorf("'%s' is neither a date (2006-01-02) nor an RFC3339 time", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func parseDeletionFreezes(value string, location *time.Location) ([]deletionFreeze, error) {
+	freezes := []deletionFreeze{}
+	for _, period := range splitList(value) {
+		bounds := strings.SplitN(period, "/", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("freeze period '%s' must be <start>/<end>", period)
+		}
+		start, err := parseFreezeBound(bounds[0], location, false)
+		if err != nil {
+			return nil, fmt.Errorf("freeze period '%s': %v", period, err)
+		}
+		end, err := parseFreezeBound(bounds[1], location, true)
+		if err != nil {
+			return nil, fmt.Errorf("freeze period '%s': %v", period, err)
+		}
+		freezes = append(freezes, deletionFreeze{start: start, end: end, reason: "freeze " + period})
+	}
+	return freezes, nil
+}
+
+// Parses a DTSTART/DTEND value: a date, a UTC time, a time in the zone given by TZID or a floating time
+func parseICalTime(value string, params map[string]string, location *time.Location) (t time.Time, isDate bool, err error) {
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err = time.ParseInLocation("20060102", value, location)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	if tzid, ok := params["TZID"]; ok {
+		if tzLocation, err := time.LoadLocation(tzid); err == nil {
+			location = tzLocation
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, location)
+	return t, false, err
+}
+
+// Reads the events of an iCalendar file as freeze periods. Recurring events (RRULE) are not expanded: only their
+// first occurrence is used, so holiday calendars must list every occurrence.
+func parseICalendar(path string, location *time.Location) ([]deletionFreeze, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// unfold the content lines: a line starting with a space or a tab continues the previous one
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	freezes := []deletionFreeze{}
+	var start, end time.Time
+	var startIsDate, inEvent bool
+	var eventSummary string
+	for n, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		nameAndParams := strings.Split(line[:colon], ";")
+		name := strings.ToUpper(nameAndParams[0])
+		value := line[colon+1:]
+		params := map[string]string{}
+		for _, param := range nameAndParams[1:] {
+			if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+				params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent = true
+			start, end, startIsDate, eventSummary = time.Time{}, time.Time{}, false, ""
+		case !inEvent:
+		case name == "SUMMARY":
+			eventSummary = value
+		case name == "DTSTART":
+			if start, startIsDate, err = parseICalTime(value, params, location); err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid DTSTART - %v", path, n+1, err)
+			}
+		case name == "DTEND":
+			if end, _, err = parseICalTime(value, params, location); err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid DTEND - %v", path, n+1, err)
+			}
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			if start.IsZero() {
+				continue
+			}
+			// without DTEND, an event on a date lasts the whole day
+			if end.IsZero() && startIsDate {
+				end = start.AddDate(0, 0, 1)
+			}
+			if end.After(start) {
+				freezes = append(freezes, deletionFreeze{start: start, end: end, reason: "holiday " + eventSummary})
+			}
+		}
+	}
+	return freezes, nil
+}
+
+func loadDeletionSchedule() (*deletionScheduleConfig, error) {
+	location, err := time.LoadLocation(*deletionTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone '%s' - %v", *deletionTimezone, err)
+	}
+	config := &deletionScheduleConfig{location: location}
+	for _, expression := range strings.Split(*deletionWindows, ";") {
+		if strings.TrimSpace(expression) == "" {
+			continue
+		}
+		window, err := parseDeletionWindow(strings.TrimSpace(expression))
+		if err != nil {
+			return nil, err
+		}
+		config.windows = append(config.windows, window)
+	}
+	if config.freezes, err = parseDeletionFreezes(*deletionFreezes, location); err != nil {
+		return nil, err
+	}
+	if *deletionHolidayCalendar != "" {
+		holidays, err := parseICalendar(*deletionHolidayCalendar, location)
+		if err != nil {
+			return nil, err
+		}
+		config.freezes = append(config.freezes, holidays...)
+	}
+	return config, nil
+}
+
+// The freeze period t is in, if any
+func (config *deletionScheduleConfig) freezeAt(t time.Time) *deletionFreeze {
+	for i, freeze := range config.freezes {
+		if !t.Before(freeze.start) && t.Before(freeze.end) {
+			return &config.freezes[i]
+		}
+	}
+	return nil
+}
+
+func (config *deletionScheduleConfig) allows(t time.Time) bool {
+	if config.freezeAt(t) != nil {
+		return false
+	}
+	if len(config.windows) == 0 {
+		return true
+	}
+	t = t.In(config.location)
+	for _, window := range config.windows {
+		if window.allows(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// The first minute after t when deletions are allowed, looking up to a year ahead
+func (config *deletionScheduleConfig) nextAllowed(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute)
+	for limit := t.AddDate(1, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if freeze := config.freezeAt(t); freeze != nil {
+			// skip the whole freeze period at once, to the first minute that starts at or after its end
+			end := freeze.end.Truncate(time.Minute)
+			if end.Before(freeze.end) {
+				end = end.Add(time.Minute)
+			}
+			t = end.Add(-time.Minute)
+			continue
+		}
+		if config.allows(t) {
+			return t, true
+		}
+	}
+	return t, false
+}
+
+// Why deletions are not allowed at time now, or an empty string
+func deletionScheduleDeferral(now time.Time) string {
+	if !deletionScheduleLoaded {
+		deletionSchedule, deletionScheduleErr = loadDeletionSchedule()
+		deletionScheduleLoaded = true
+		if deletionScheduleErr != nil {
+			klog.Errorf("ERROR: invalid deletion schedule, deletions after the grace period are blocked - %v", deletionScheduleErr)
+		}
+	}
+	if deletionScheduleErr != nil {
+		return fmt.Sprintf("invalid deletion schedule - %v", deletionScheduleErr)
+	}
+	if deletionScheduleCheckedAt.Equal(now.Truncate(time.Minute)) {
+		return deletionScheduleReason
+	}
+	deletionScheduleCheckedAt = now.Truncate(time.Minute)
+	deletionScheduleReason = ""
+	if deletionSchedule.allows(now) {
+		return ""
+	}
+
+	reason := "outside the deletion windows"
+	if freeze := deletionSchedule.freezeAt(now); freeze != nil {
+		reason = "deletions are frozen (" + freeze.reason + ")"
+	}
+	if next, ok := deletionSchedule.nextAllowed(now); ok {
+		reason += ", deferred until " + next.In(deletionSchedule.location).Format(time.RFC3339)
+	}
+	deletionScheduleReason = reason
+	return reason
+}
+
+// Deletion guard: defers the deletions due to an expired (or, under storage pressure, shortened) grace period to the
+// next time the schedule allows them
+func deletionScheduleGuard(persV v1.PersistentVolume, trigger string) string {
+	if trigger == deletionTriggerImmediate {
+		return ""
+	}
+	return deletionScheduleDeferral(time.Now())
+}
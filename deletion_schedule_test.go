@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseDeletionWindow(t *testing.T) {
+	cases := []struct {
+		expression string
+		at         time.Time
+		expected   bool
+	}{
+		// Monday 6 January 2020
+		{"* 8-17 * * 1-5", time.Date(2020, 1, 6, 8, 0, 0, 0, time.UTC), true},
+		{"* 8-17 * * 1-5", time.Date(2020, 1, 6, 18, 0, 0, 0, time.UTC), false},
+		{"* 8-17 * * 1-5", time.Date(2020, 1, 5, 10, 0, 0, 0, time.UTC), false},
+		{"*/15 * * * *", time.Date(2020, 1, 6, 10, 30, 0, 0, time.UTC), true},
+		{"*/15 * * * *", time.Date(2020, 1, 6, 10, 31, 0, 0, time.UTC), false},
+		{"0,30 2 * 1,7 *", time.Date(2020, 7, 1, 2, 30, 0, 0, time.UTC), true},
+		{"0,30 2 * 1,7 *", time.Date(2020, 6, 1, 2, 30, 0, 0, time.UTC), false},
+		// Sunday is both 0 and 7
+		{"* * * * 7", time.Date(2020, 1, 5, 10, 0, 0, 0, time.UTC), true},
+		// day of month or day of week when both are restricted, as in cron
+		{"* * 1 * 1", time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC), true},
+		{"* * 1 * 1", time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC), true},
+		{"* * 1 * 1", time.Date(2020, 1, 7, 10, 0, 0, 0, time.UTC), false},
+	}
+	for _, c := range cases {
+		window, err := parseDeletionWindow(c.expression)
+		if err != nil {
+			t.Errorf("'%s': %v", c.expression, err)
+			continue
+		}
+		if allowed := window.allows(c.at); allowed != c.expected {
+			t.Errorf("'%s' at %s: allowed is %v, expected %v", c.expression, c.at, allowed, c.expected)
+		}
+	}
+
+	for _, invalid := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseDeletionWindow(invalid); err == nil {
+			t.Errorf("'%s' accepted", invalid)
+		}
+	}
+}
+
+func TestParseDeletionFreezes(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skip(err)
+	}
+	freezes, err := parseDeletionFreezes("2026-12-18/2027-01-05, 2026-06-01T10:00:00Z/2026-06-01T12:00:00Z", location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(freezes) != 2 {
+		t.Fatalf("expected 2 freezes, got %d", len(freezes))
+	}
+	// dates are whole days in the location, the end date included
+	if expected := time.Date(2026, 12, 18, 0, 0, 0, 0, location); !freezes[0].start.Equal(expected) {
+		t.Errorf("start is %s, expected %s", freezes[0].start, expected)
+	}
+	if expected := time.Date(2027, 1, 6, 0, 0, 0, 0, location); !freezes[0].end.Equal(expected) {
+		t.Errorf("end is %s, expected %s", freezes[0].end, expected)
+	}
+	if expected := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC); !freezes[1].end.Equal(expected) {
+		t.Errorf("end is %s, expected %s", freezes[1].end, expected)
+	}
+
+	for _, invalid := range []string{"2026-12-18", "2026-12-18/tomorrow", "18.12.2026/2027-01-05"} {
+		if _, err := parseDeletionFreezes(invalid, location); err == nil {
+			t.Errorf("'%s' accepted", invalid)
+		}
+	}
+}
+
+func TestParseICalendar(t *testing.T) {
+	location, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Skip(err)
+	}
+	file, err := ioutil.TempFile("", "holidays*.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Christmas\r\nDTSTART;VALUE=DATE:20261225\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Annual\r\n  closure\r\nDTSTART;VALUE=DATE:20261221\r\nDTEND;VALUE=DATE:20270105\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Maintenance\r\nDTSTART:20260601T080000Z\r\nDTEND;TZID=America/New_York:20260601T060000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:Floating\r\nDTSTART:20260701T080000\r\nDTEND:20260701T100000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nSUMMARY:No start\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n")
+	file.Close()
+
+	freezes, err := parseICalendar(file.Name(), location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []deletionFreeze{
+		{time.Date(2026, 12, 25, 0, 0, 0, 0, location), time.Date(2026, 12, 26, 0, 0, 0, 0, location), "holiday Christmas"},
+		{time.Date(2026, 12, 21, 0, 0, 0, 0, location), time.Date(2027, 1, 5, 0, 0, 0, 0, location), "holiday Annual closure"},
+		{time.Date(2026, 6, 1, 8, 0, 0, 0, time.UTC), time.Date(2026, 6, 1, 10, 0, 0, 0, time.UTC), "holiday Maintenance"},
+		{time.Date(2026, 7, 1, 8, 0, 0, 0, location), time.Date(2026, 7, 1, 10, 0, 0, 0, location), "holiday Floating"},
+	}
+	if len(freezes) != len(expected) {
+		t.Fatalf("expected %d freezes, got %v", len(expected), freezes)
+	}
+	for i := range expected {
+		if !freezes[i].start.Equal(expected[i].start) || !freezes[i].end.Equal(expected[i].end) || freezes[i].reason != expected[i].reason {
+			t.Errorf("freeze %d is %v, expected %v", i, freezes[i], expected[i])
+		}
+	}
+}
+
+func TestNextAllowed(t *testing.T) {
+	window, err := parseDeletionWindow("* 8-17 * * 1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &deletionScheduleConfig{
+		location: time.UTC,
+		windows:  []deletionWindow{window},
+		freezes: []deletionFreeze{{
+			start:  time.Date(2020, 1, 8, 0, 0, 0, 0, time.UTC),
+			end:    time.Date(2020, 1, 10, 9, 30, 30, 0, time.UTC),
+			reason: "freeze",
+		}},
+	}
+	cases := []struct {
+		name     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"within a window", time.Date(2020, 1, 6, 10, 15, 20, 0, time.UTC), time.Date(2020, 1, 6, 10, 15, 0, 0, time.UTC)},
+		{"after hours", time.Date(2020, 1, 6, 18, 0, 0, 0, time.UTC), time.Date(2020, 1, 7, 8, 0, 0, 0, time.UTC)},
+		{"weekend", time.Date(2020, 1, 4, 12, 0, 0, 0, time.UTC), time.Date(2020, 1, 6, 8, 0, 0, 0, time.UTC)},
+		{"freeze ending within a minute", time.Date(2020, 1, 7, 18, 0, 0, 0, time.UTC), time.Date(2020, 1, 10, 9, 31, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		next, ok := config.nextAllowed(c.from)
+		if !ok || !next.Equal(c.expected) {
+			t.Errorf("%s: next allowed is %s (%v), expected %s", c.name, next, ok, c.expected)
+		}
+	}
+
+	// never allowed within a year
+	config.freezes = []deletionFreeze{{start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), end: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	if next, ok := config.nextAllowed(time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC)); ok {
+		t.Errorf("next allowed is %s, expected none", next)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	html_template "html/template"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/klog"
+)
+
+var (
+	smtpServer                = flag.String("smtpServer", "", "host:port of the SMTP relay used to send email notifications. Email notifications are disabled if empty")
+	smtpFrom                  = flag.String("smtpFrom", "openshift-admins@cern.ch", "sender of the email notifications")
+	smtpUsername              = flag.String("smtpUsername", "", "username to authenticate to the SMTP relay (the password is read from the SMTP_PASSWORD environment variable). No authentication if empty")
+	emailRecipientAnnotations = flag.String("emailRecipientAnnotations", "openshift.io/requester", "comma-separated list of captured namespace annotations holding the owner of a volume, in order of preference")
+	emailRecipientDomain      = flag.String("emailRecipientDomain", "cern.ch", "domain added to owners that are usernames rather than email addresses")
+	emailFallbackRecipient    = flag.String("emailFallbackRecipient", "", "recipient of the notifications of volumes whose owner is unknown. They are not emailed if empty")
+	emailSubject              = flag.String("emailSubject", "Retained volumes of your deleted PVCs", "subject of the email notifications")
+	emailTemplatesDir         = flag.String("emailTemplatesDir", "", "directory with email.txt.tmpl and email.html.tmpl overriding the default email bodies")
+)
+
+const defaultEmailTextTemplate = `Hello,
+
+This is an automatic message about the volumes of deleted PVCs in your projects:
+{{range .Volumes}}
+- {{.Message}}{{end}}
+
+Please contact the administrators if you need one of these volumes back before it is deleted.
+`
+
+const defaultEmailHTMLTemplate = `<html><body>
+<p>Hello,</p>
+<p>This is an automatic message about the volumes of deleted PVCs in your projects:</p>
+<table border="1" cellpadding="4" style="border-collapse: collapse">
+<tr><th>Namespace</th><th>PVC</th><th>Capacity</th><th>Deletion date</th><th></th></tr>
+{{range .Volumes}}<tr><td>{{.Namespace}}</td><td>{{.ClaimName}}</td><td>{{.Capacity}}</td><td>{{.DeletionTimestamp}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+<p>Please contact the administrators if you need one of these volumes back before it is deleted.</p>
+</body></html>
+`
+
+// What the email templates get: all the notifications for one recipient
+type emailData struct {
+	Recipient string
+	Volumes   []emailVolume
+}
+
+type emailVolume struct {
+	notification
+	Message string
+}
+
+// Sends one email per recipient with all their notifications of the run
+type emailSink struct {
+	server string
+	from   string
+	auth   smtp.Auth
+}
+
+func newEmailSink() *emailSink {
+	sink := &emailSink{server: *smtpServer, from: *smtpFrom}
+	if *smtpUsername != "" {
+		host, _, _ := net.SplitHostPort(*smtpServer)
+		sink.auth = smtp.PlainAuth("", *smtpUsername, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return sink
+}
+
+// Finds whom to email about a volume: the first configured annotation captured from its namespace, otherwise the
+// fallback recipient. Not the PVC annotations: any user of the namespace could send the notifications anywhere with them.
+// Notifications meant for admins go to adminEmail.
+func emailRecipient(n notification) string {
+	if n.Event == notificationApprovalRequired {
+		return *adminEmail
+	}
+	for _, key := range splitList(*emailRecipientAnnotations) {
+		owner := n.Metadata.NamespaceAnnotations[key]
+		if owner == "" {
+			continue
+		}
+		// annotations are set by users: no line breaks in the headers
+		owner = headerValue(owner)
+		if !strings.Contains(owner, "@") && *emailRecipientDomain != "" {
+			owner = owner + "@" + *emailRecipientDomain
+		}
+		return owner
+	}
+	return *emailFallbackRecipient
+}
+
+func (sink *emailSink) name() string {
+	return "email"
+}
+
+func (sink *emailSink) send(notifications []notification) []bool {
+	delivered := make([]bool, len(notifications))
+	byRecipient := map[string][]emailVolume{}
+	indexes := map[string][]int{}
+	for i, n := range notifications {
+		recipient := emailRecipient(n)
+		if recipient == "" {
+			klog.V(2).Infof("no email recipient for the %s notification of PV %s", n.Event, n.PersistentVolume)
+			// nobody to send it to, now or later
+			delivered[i] = true
+			continue
+		}
+		message, err := renderNotification(n)
+		if err != nil {
+			klog.Errorf("ERROR: rendering the %s notification of PV %s - %v", n.Event, n.PersistentVolume, err)
+			continue
+		}
+		byRecipient[recipient] = append(byRecipient[recipient], emailVolume{n, message})
+		indexes[recipient] = append(indexes[recipient], i)
+	}
+
+	recipients := []string{}
+	for recipient := range byRecipient {
+		recipients = append(recipients, recipient)
+	}
+	sort.Strings(recipients)
+	for _, recipient := range recipients {
+		message, err := buildEmail(sink.from, emailData{Recipient: recipient, Volumes: byRecipient[recipient]})
+		if err != nil {
+			klog.Errorf("ERROR: building the email to %s - %v", recipient, err)
+			break
+		}
+		if err := smtp.SendMail(sink.server, sink.auth, sink.from, []string{recipient}, message); err != nil {
+			// e.g. an owner that is not a valid address (system:admin): the other recipients still get their email
+			if smtpErr, ok := err.(*textproto.Error); ok && smtpErr.Code >= 500 {
+				// rejected for good, it would be rejected again at every run until the notification expires
+				klog.Warningf("WARNING: email to %s rejected, not retrying - %v", recipient, err)
+				for _, i := range indexes[recipient] {
+					delivered[i] = true
+				}
+				continue
+			}
+			klog.Errorf("ERROR: sending email to %s - %v", recipient, err)
+			continue
+		}
+		klog.V(2).Infof("sent email about %d volume(s) to %s", len(byRecipient[recipient]), recipient)
+		for _, i := range indexes[recipient] {
+			delivered[i] = true
+		}
+	}
+	return delivered
+}
+
+// Reads a template from emailTemplatesDir, or returns the default
+func emailTemplateText(fileName, defaultText string) string {
+	if *emailTemplatesDir != "" {
+		if content, err := ioutil.ReadFile(filepath.Join(*emailTemplatesDir, fileName)); err == nil {
+			return string(content)
+		}
+	}
+	return defaultText
+}
+
+// Builds a multipart/alternative email with a text and an HTML body
+func buildEmail(from string, data emailData) ([]byte, error) {
+	textTemplate, err := template.New("text").Parse(emailTemplateText("email.txt.tmpl", defaultEmailTextTemplate))
+	if err != nil {
+		return nil, err
+	}
+	htmlTemplate, err := html_template.New("html").Parse(emailTemplateText("email.html.tmpl", defaultEmailHTMLTemplate))
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		render      func(*bytes.Buffer) error
+	}{
+		{"text/plain; charset=utf-8", func(b *bytes.Buffer) error { return textTemplate.Execute(b, data) }},
+		{"text/html; charset=utf-8", func(b *bytes.Buffer) error { return htmlTemplate.Execute(b, data) }},
+	} {
+		var content bytes.Buffer
+		if err := part.render(&content); err != nil {
+			return nil, err
+		}
+		partWriter, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return nil, err
+		}
+		partWriter.Write(content.Bytes())
+	}
+	writer.Close()
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&message, "To: %s\r\n", headerValue(data.Recipient))
+	fmt.Fprintf(&message, "Subject: %s\r\n", headerValue(*emailSubject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// Removes the line breaks that would let a value add headers to the email
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A minimal SMTP server accepting the emails of net/smtp, rejecting the recipients containing "system:"
+type fakeSMTPServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	// message received for each recipient
+	messages map[string]string
+}
+
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTPServer{listener: listener, messages: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost fake SMTP")
+	recipients := []string{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch {
+		case command == "EHLO" || command == "HELO":
+			text.PrintfLine("250 localhost")
+		case strings.HasPrefix(strings.ToUpper(line), "MAIL FROM:"):
+			text.PrintfLine("250 OK")
+		case strings.HasPrefix(strings.ToUpper(line), "RCPT TO:"):
+			recipient := strings.Trim(line[len("RCPT TO:"):], "<>")
+			if strings.Contains(recipient, "system:") {
+				text.PrintfLine("550 5.1.1 <%s>: recipient address rejected", recipient)
+				continue
+			}
+			recipients = append(recipients, recipient)
+			text.PrintfLine("250 OK")
+		case command == "DATA":
+			text.PrintfLine("354 end with <CRLF>.<CRLF>")
+			data, err := ioutil.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			server.mutex.Lock()
+			for _, recipient := range recipients {
+				server.messages[recipient] = string(data)
+			}
+			server.mutex.Unlock()
+			recipients = nil
+			text.PrintfLine("250 OK")
+		case command == "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func testEmailNotification(pvName, owner string) notification {
+	return notification{
+		Event:             notificationScheduled,
+		PersistentVolume:  pvName,
+		ClaimName:         "data",
+		Namespace:         "project",
+		DeletionTimestamp: "2020-01-31T00:00:00Z",
+		Metadata:          claimMetadata{NamespaceAnnotations: map[string]string{"openshift.io/requester": owner}},
+	}
+}
+
+func TestEmailSinkSkipsRejectedRecipients(t *testing.T) {
+	server := startFakeSMTPServer(t)
+	defer server.listener.Close()
+
+	sink := &emailSink{server: server.listener.Addr().String(), from: "admins@example.com"}
+	notifications := []notification{
+		testEmailNotification("pv-admin", "system:admin"),
+		testEmailNotification("pv-jdoe", "jdoe"),
+		testEmailNotification("pv-other", "other@example.com\r\nBcc: victim@example.com"),
+	}
+	delivered := sink.send(notifications)
+	if recipient := emailRecipient(notification{Metadata: claimMetadata{ClaimAnnotations: map[string]string{"openshift.io/requester": "attacker@example.com"}}}); recipient != *emailFallbackRecipient {
+		t.Errorf("recipient taken from the PVC annotations: %s", recipient)
+	}
+
+	// the rejected recipient is not retried either
+	expected := []bool{true, true, true}
+	for i := range expected {
+		if delivered[i] != expected[i] {
+			t.Errorf("notification of %s: delivered is %v, expected %v", notifications[i].PersistentVolume, delivered[i], expected[i])
+		}
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if !strings.Contains(server.messages["jdoe@cern.ch"], "pv-jdoe") {
+		t.Errorf("no email about pv-jdoe received by jdoe@cern.ch: %v", server.messages)
+	}
+	for recipient, message := range server.messages {
+		if strings.Contains(message, "\nBcc:") {
+			t.Errorf("header injected in the email to %s:\n%s", recipient, message)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Events about cluster-scoped objects such as PVs go to the default namespace, like the PV controller does
+const clusterScopedEventsNamespace = "default"
+
+// Creates a Kubernetes event on a PV, so admins see it with `oc describe pv` and alerting on events picks it up
+func recordPVEvent(persV v1.PersistentVolume, eventType, reason, message string) {
+	now := meta_v1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			GenerateName: persV.Name + ".",
+			Namespace:    clusterScopedEventsNamespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       "PersistentVolume",
+			APIVersion: "v1",
+			Name:       persV.Name,
+			UID:        persV.UID,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: managedByValue},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := kubeclient.kubeclient.CoreV1().Events(clusterScopedEventsNamespace).Create(event); err != nil {
+		klog.Errorf("ERROR: creating event %s for PV %s - %v", reason, persV.Name, err)
+	}
+}
+
+// Creates a Kubernetes event on a namespace, so its users see it with `oc get events`
+func recordNamespaceEvent(namespace, eventType, reason, message string) {
+	now := meta_v1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			GenerateName: namespace + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:       "Namespace",
+			APIVersion: "v1",
+			Name:       namespace,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         v1.EventSource{Component: managedByValue},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	if _, err := kubeclient.kubeclient.CoreV1().Events(namespace).Create(event); err != nil {
+		klog.Errorf("ERROR: creating event %s for namespace %s - %v", reason, namespace, err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+	"strconv"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// What to do with PVs in the Failed phase
+const (
+	failedVolumePolicyReport      = "report"
+	failedVolumePolicyRetryDelete = "retry-delete"
+	failedVolumePolicyAlert       = "alert"
+)
+
+var failedVolumePolicy = flag.String("failedVolumePolicy", failedVolumePolicyReport, "what to do with PVs in the Failed phase: report (log, report and metrics only), retry-delete (also re-trigger the deletion of PVs whose reclaim policy is Delete) or alert (also create a Warning event on the PV)")
+
+// The failure ("<category>: <status.message>") of a Failed PV its VolumeFailed event was created for, to alert once per failure
+const annotationFailureAlerted = "reclaim-volumes.cern.ch/failure-alerted"
+
+// Categories of failures, recognized from the PV status.message. The first matching one is used.
+var failedVolumeCategories = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"volume-in-use", regexp.MustCompile(`(?i)in use|busy|still mounted`)},
+	{"recycle-error", regexp.MustCompile(`(?i)recycl`)},
+	{"backend-not-found", regexp.MustCompile(`(?i)not found|does not exist|no such`)},
+	{"permission-denied", regexp.MustCompile(`(?i)permission denied|forbidden|unauthorized`)},
+	{"delete-error", regexp.MustCompile(`(?i)delet|rpc error|provisioner`)},
+}
+
+const failedVolumeCategoryUnknown = "unknown"
+
+// All categories, to reset their metrics at every run
+func allFailedVolumeCategories() []string {
+	categories := []string{}
+	for _, category := range failedVolumeCategories {
+		categories = append(categories, category.name)
+	}
+	return append(categories, failedVolumeCategoryUnknown)
+}
+
+func classifyVolumeFailure(message string) string {
+	for _, category := range failedVolumeCategories {
+		if category.pattern.MatchString(message) {
+			return category.name
+		}
+	}
+	return failedVolumeCategoryUnknown
+}
+
+// Failed PVs are not reclaimed by the PV controller and would leak capacity silently: report them, and depending on
+// failedVolumePolicy retry their deletion or alert
+func handleFailedVolume(persV v1.PersistentVolume) {
+	category := classifyVolumeFailure(persV.Status.Message)
+	summary.FailedVolumes++
+	if summary.FailedByCategory == nil {
+		summary.FailedByCategory = map[string]int{}
+	}
+	summary.FailedByCategory[category]++
+	klog.Warningf("WARNING: PV %s is Failed (%s): %s", persV.Name, category, persV.Status.Message)
+
+	switch *failedVolumePolicy {
+	case failedVolumePolicyRetryDelete:
+		// never delete a volume whose owner wanted it retained
+		if persV.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+			return
+		}
+		retries, _ := strconv.Atoi(persV.ObjectMeta.Annotations[annotationReclaimRetries])
+		if retries >= *stuckReclaimMaxRetries || reclaimPausedReason() != "" {
+			return
+		}
+		if err := retriggerPVDeletion(persV, retries+1); err != nil {
+			klog.Errorf("ERROR: re-triggering deletion of Failed PV %s - %v", persV.Name, err)
+			return
+		}
+		summary.RetriedReclaims++
+		recordAudit(persV, auditReclaimRetried, "Failed ("+category+"): "+persV.Status.Message, map[string]string{annotationReclaimRetries: strconv.Itoa(retries + 1)})
+	case failedVolumePolicyAlert:
+		failure := category + ": " + persV.Status.Message
+		if persV.ObjectMeta.Annotations[annotationFailureAlerted] == failure {
+			return
+		}
+		recordPVEvent(persV, v1.EventTypeWarning, "VolumeFailed", "volume is Failed ("+category+") and will not be reclaimed: "+persV.Status.Message)
+		setPVAnnotations(persV.Name, map[string]string{annotationFailureAlerted: failure})
+	}
+}
@@ -1,23 +1,35 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	kubeconfig         = flag.String("kubeconfig", "", "kubeconfig file to run the commands (inspect, approve...) from outside the cluster, with your own credentials. If empty, the serviceaccount of the pod when running in one, else $KUBECONFIG or ~/.kube/config")
+	reclaimerNamespace = flag.String("namespace", "", "namespace of the reclaimer, where its ConfigMaps and Secrets are. From the serviceaccount of the pod if empty")
 )
 
-// Declare a kubeclient as a global var to be accessible by all the functions
-// when running in a pod, this will automatically use the pod's serviceaccount to access the cluster API
-var kubeclient = Kubeclient{kubeclient: NewKubeClient()}
+// Declare a kubeclient as a global var to be accessible by all the functions.
+// It is created by main once the flags are parsed: when running in a pod, this will automatically use the pod's
+// serviceaccount to access the cluster API
+var kubeclient Kubeclient
 
 type Kubeclient struct {
 	kubeclient *kubernetes.Clientset
 }
 
 // Creates a client
-func NewKubeClient() *kubernetes.Clientset {
+func NewKubeClient() Kubeclient {
 
-	// creates the in-cluster config
-	config, err := rest.InClusterConfig()
+	config, err := kubeClientConfig()
 	if err != nil {
 		panic(err.Error())
 	}
@@ -26,5 +38,51 @@ func NewKubeClient() *kubernetes.Clientset {
 	if err != nil {
 		panic(err.Error())
 	}
-	return clientset
+	return Kubeclient{kubeclient: clientset}
+}
+
+// The in-cluster config, unless a kubeconfig is given or the reclaimer does not run in a pod
+func kubeClientConfig() (*rest.Config, error) {
+	if *kubeconfig == "" {
+		if config, err := rest.InClusterConfig(); err == nil {
+			return config, nil
+		}
+	}
+	// the current context of -kubeconfig, else of $KUBECONFIG or ~/.kube/config, as kubectl and oc read them
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = *kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("not running in a pod and cannot load kubeconfig - %v", err)
+	}
+	return config, nil
+}
+
+// The user the API server authenticates the client as, from the OpenShift user API
+func authenticatedUser() (string, error) {
+	user := struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}{}
+	content, err := kubeclient.kubeclient.CoreV1().RESTClient().Get().AbsPath("/apis/user.openshift.io/v1/users/~").DoRaw()
+	if err != nil {
+		return "", fmt.Errorf("getting the authenticated user from the OpenShift user API - %v", err)
+	}
+	if err := json.Unmarshal(content, &user); err != nil || user.Metadata.Name == "" {
+		return "", fmt.Errorf("invalid user from the OpenShift user API '%s' - %v", content, err)
+	}
+	return user.Metadata.Name, nil
+}
+
+// Returns the namespace the reclaimer runs in, from its serviceaccount. Used as default location of the objects it manages.
+func currentNamespace() string {
+	if *reclaimerNamespace != "" {
+		return *reclaimerNamespace
+	}
+	namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "default"
+	}
+	return strings.TrimSpace(string(namespace))
 }
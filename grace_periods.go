@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// A small scratch volume and a large dataset should not be retained for the same time. When a capacity policy is
+// configured, the grace period of the PVs that are to be reclaimed (they have a valid
+// annotationPeriodReclaimVolumesAfterRelease, usually set for the whole StorageClass) depends on their capacity,
+// unless an admin set annotationGracePeriodOverride on the PV.
+
+// explicit grace period of a PV, taking precedence over the capacity policy
+const annotationGracePeriodOverride = "reclaim-volumes.cern.ch/deletion-grace-period-override"
+
+const tebibyte = 1 << 40
+
+var (
+	capacityGracePeriodTiers  = flag.String("capacityGracePeriodTiers", "", "comma-separated <minimum capacity>=<grace period> tiers setting the grace period of PVs by capacity, e.g. '0=24h,100Gi=168h,1Ti=720h'. Takes precedence over the formula")
+	capacityGracePeriodBase   = flag.Duration("capacityGracePeriodBase", 0, "grace period formula: grace period of an empty volume, extended by -capacityGracePeriodPerTiB")
+	capacityGracePeriodPerTiB = flag.Duration("capacityGracePeriodPerTiB", 0, "grace period formula: extension of the grace period per TiB of capacity")
+	capacityGracePeriodMax    = flag.Duration("capacityGracePeriodMax", 0, "grace period formula: maximum grace period. No maximum if 0")
+)
+
+type gracePeriodTier struct {
+	minimumCapacity resource.Quantity
+	gracePeriod     time.Duration
+}
+
+// Parsed on first use. Invalid tiers are ignored: the grace periods of the annotations apply.
+var (
+	gracePeriodTiers       []gracePeriodTier
+	gracePeriodTiersLoaded bool
+)
+
+func parseGracePeriodTiers(value string) ([]gracePeriodTier, error) {
+	tiers := []gracePeriodTier{}
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("tier '%s' must be <minimum capacity>=<grace period>", item)
+		}
+		minimumCapacity, err := resource.ParseQuantity(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("tier '%s': invalid capacity - %v", item, err)
+		}
+		gracePeriod, err := time.ParseDuration(parts[1])
+		if err != nil || gracePeriod <= 0 {
+			return nil, fmt.Errorf("tier '%s': invalid grace period", item)
+		}
+		tiers = append(tiers, gracePeriodTier{minimumCapacity, gracePeriod})
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].minimumCapacity.Cmp(tiers[j].minimumCapacity) < 0 })
+	return tiers, nil
+}
+
+func getGracePeriodTiers() []gracePeriodTier {
+	if !gracePeriodTiersLoaded {
+		gracePeriodTiersLoaded = true
+		tiers, err := parseGracePeriodTiers(*capacityGracePeriodTiers)
+		if err != nil {
+			klog.Errorf("ERROR: ignoring -capacityGracePeriodTiers - %v", err)
+		}
+		gracePeriodTiers = tiers
+	}
+	return gracePeriodTiers
+}
+
+// The grace period of a PV according to its capacity, and how it was computed. Returns 0 if no capacity policy applies.
+func capacityScaledGracePeriod(persV v1.PersistentVolume) (time.Duration, string) {
+	capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]
+	if !ok {
+		return 0, ""
+	}
+	if tiers := getGracePeriodTiers(); len(tiers) > 0 {
+		for i := len(tiers) - 1; i >= 0; i-- {
+			if capacity.Cmp(tiers[i].minimumCapacity) >= 0 {
+				return tiers[i].gracePeriod, fmt.Sprintf("capacity %s, tier from %s", capacity.String(), tiers[i].minimumCapacity.String())
+			}
+		}
+		// smaller than the first tier
+		return 0, ""
+	}
+	if *capacityGracePeriodBase <= 0 && *capacityGracePeriodPerTiB <= 0 {
+		return 0, ""
+	}
+	gracePeriod := *capacityGracePeriodBase + time.Duration(float64(capacity.Value())/tebibyte*float64(*capacityGracePeriodPerTiB))
+	explanation := fmt.Sprintf("capacity %s, %v + %v per TiB", capacity.String(), *capacityGracePeriodBase, *capacityGracePeriodPerTiB)
+	if *capacityGracePeriodMax > 0 && gracePeriod > *capacityGracePeriodMax {
+		gracePeriod = *capacityGracePeriodMax
+		explanation += fmt.Sprintf(", capped at %v", *capacityGracePeriodMax)
+	}
+	if gracePeriod <= 0 {
+		return 0, ""
+	}
+	return gracePeriod.Round(time.Minute), explanation
+}
+
+// The grace period set by an admin on the PV, if valid
+func gracePeriodOverride(persV v1.PersistentVolume) time.Duration {
+	override, err := time.ParseDuration(persV.ObjectMeta.Annotations[annotationGracePeriodOverride])
+	if err != nil || override <= 0 {
+		return 0
+	}
+	return override
+}
+
+// How getPVReclaimingGracePeriod got the grace period of a PV
+func gracePeriodSource(persV v1.PersistentVolume) string {
+	if getPVReclaimingGracePeriod(persV) == 0 {
+		return "no valid " + annotationPeriodReclaimVolumesAfterRelease + " annotation, the PV is never reclaimed"
+	}
+	if gracePeriodOverride(persV) > 0 {
+		return annotationGracePeriodOverride + " annotation"
+	}
+	source := annotationPeriodReclaimVolumesAfterRelease + " annotation"
+	if gracePeriod, explanation := capacityScaledGracePeriod(persV); gracePeriod > 0 {
+		source = explanation
+	}
+	if unusedVolumeGracePeriod(persV) == getPVReclaimingGracePeriod(persV) {
+		source = fmt.Sprintf("not mounted during %v before its release", *unusedThreshold)
+	}
+	return source
+}
+
+// explain command: shows how the reclaimer decides when a PV is deleted
+func runExplain(args []string) {
+	if len(args) != 1 {
+		klog.Fatalf("ERROR: usage: explain <pv>")
+	}
+	persV, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Get(args[0], meta_v1.GetOptions{})
+	if err != nil {
+		klog.Fatalf("ERROR: getting PV %s - %v", args[0], err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	row := func(name string, value interface{}) { fmt.Fprintf(writer, "%s:\t%v\n", name, value) }
+	row("PV", persV.Name)
+	if persV.Spec.ClaimRef != nil {
+		row("Claim", persV.Spec.ClaimRef.Namespace+"/"+persV.Spec.ClaimRef.Name)
+	}
+	if capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]; ok {
+		row("Capacity", capacity.String())
+	}
+	row("Phase", persV.Status.Phase)
+	row("Reclaim policy", persV.Spec.PersistentVolumeReclaimPolicy)
+	row("Grace period", getPVReclaimingGracePeriod(*persV))
+	row("Grace period from", gracePeriodSource(*persV))
+	row("Immediate deletion", pvCanBeReclaimedImmediately(*persV))
+	if value, ok := persV.ObjectMeta.Annotations[annotationFirstMounted]; ok {
+		row("First mounted", value)
+		row("Last mounted", persV.ObjectMeta.Annotations[annotationLastMounted])
+	} else if pvWasNeverMounted(*persV) {
+		row("First mounted", "never")
+		row("Immediate deletion (never mounted)", pvCanBeReclaimedNeverMounted(*persV))
+	}
+	if content, ok := pvContent(*persV); ok {
+		row("Content", fmt.Sprintf("%d file(s), %s, inspected on %s", content.Files, formatBytes(content.Bytes), persV.ObjectMeta.Annotations[annotationInspectedAt]))
+		row("Immediate deletion (empty)", pvCanBeReclaimedEmpty(*persV))
+	} else if message, ok := persV.ObjectMeta.Annotations[annotationInspectionError]; ok {
+		row("Content", "inspection failed: "+message)
+	}
+	if deletionTimestamp, ok := persV.ObjectMeta.Annotations[annotationDelete]; ok {
+		row("Deletion timestamp", deletionTimestamp)
+	} else if gracePeriod := getPVReclaimingGracePeriod(*persV); gracePeriod > 0 {
+		row("Deletion timestamp", "not set yet, "+gracePeriod.String()+" after the PV is processed as Released")
+	}
+	writer.Flush()
+}
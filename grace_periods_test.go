@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func testPVWithCapacity(capacity string) v1.PersistentVolume {
+	return v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(capacity)}}}
+}
+
+func TestParseGracePeriodTiers(t *testing.T) {
+	tiers, err := parseGracePeriodTiers("1Ti=720h, 0=24h,100Gi=168h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Duration{24 * time.Hour, 168 * time.Hour, 720 * time.Hour}
+	if len(tiers) != len(expected) {
+		t.Fatalf("expected %d tiers, got %v", len(expected), tiers)
+	}
+	for i := range expected {
+		if tiers[i].gracePeriod != expected[i] {
+			t.Errorf("tier %d has grace period %v, expected %v (sorted by capacity)", i, tiers[i].gracePeriod, expected[i])
+		}
+	}
+
+	for _, invalid := range []string{"100Gi", "lots=24h", "100Gi=soon", "100Gi=-24h", "100Gi=0s"} {
+		if _, err := parseGracePeriodTiers(invalid); err == nil {
+			t.Errorf("'%s' accepted", invalid)
+		}
+	}
+}
+
+func TestCapacityScaledGracePeriod(t *testing.T) {
+	defer func(tiers string, base, perTiB, max time.Duration) {
+		*capacityGracePeriodTiers, *capacityGracePeriodBase, *capacityGracePeriodPerTiB, *capacityGracePeriodMax = tiers, base, perTiB, max
+		gracePeriodTiersLoaded = false
+	}(*capacityGracePeriodTiers, *capacityGracePeriodBase, *capacityGracePeriodPerTiB, *capacityGracePeriodMax)
+
+	cases := []struct {
+		name              string
+		tiers             string
+		base, perTiB, max time.Duration
+		capacity          string
+		expected          time.Duration
+	}{
+		{"no policy", "", 0, 0, 0, "1Ti", 0},
+		{"first tier", "10Gi=24h,100Gi=168h,1Ti=720h", 0, 0, 0, "50Gi", 24 * time.Hour},
+		{"tier minimum included", "10Gi=24h,100Gi=168h,1Ti=720h", 0, 0, 0, "100Gi", 168 * time.Hour},
+		{"last tier", "10Gi=24h,100Gi=168h,1Ti=720h", 0, 0, 0, "5Ti", 720 * time.Hour},
+		{"smaller than the first tier", "10Gi=24h,100Gi=168h", 0, 0, 0, "1Gi", 0},
+		{"tiers take precedence over the formula", "0=24h", time.Hour, time.Hour, 0, "1Ti", 24 * time.Hour},
+		{"formula", "", 24 * time.Hour, 48 * time.Hour, 0, "512Gi", 48 * time.Hour},
+		{"formula capped", "", 24 * time.Hour, 48 * time.Hour, 72 * time.Hour, "10Ti", 72 * time.Hour},
+		{"formula without base", "", 0, 24 * time.Hour, 0, "2Ti", 48 * time.Hour},
+	}
+	for _, c := range cases {
+		*capacityGracePeriodTiers, *capacityGracePeriodBase, *capacityGracePeriodPerTiB, *capacityGracePeriodMax = c.tiers, c.base, c.perTiB, c.max
+		gracePeriodTiersLoaded = false
+		if gracePeriod, _ := capacityScaledGracePeriod(testPVWithCapacity(c.capacity)); gracePeriod != c.expected {
+			t.Errorf("%s: grace period of %s is %v, expected %v", c.name, c.capacity, gracePeriod, c.expected)
+		}
+	}
+}
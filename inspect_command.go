@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// inspect command: lets an admin look inside a Released volume ("was my file still there?") through a debug pod in an
+// admin namespace, with the volume mounted read-only via a temporary binding (see temporary_binding.go). On exit, the
+// PV gets back its original claimRef; its reclaim annotations are not touched, so its grace period is unaffected.
+
+var (
+	debugNamespace = flag.String("debugNamespace", "", "inspect command: namespace of the debug pods and of the PVCs temporarily binding the inspected PVs. The namespace of the reclaimer if empty")
+	debugImage     = flag.String("debugImage", "busybox", "inspect command: image of the debug pods, with a shell")
+	debugTimeout   = flag.Duration("debugTimeout", 2*time.Hour, "inspect command: the debug pod stops after this, and the temporary binding of a PV is ended by the next run if the command was interrupted")
+)
+
+func getDebugNamespace() string {
+	if *debugNamespace == "" {
+		return currentNamespace()
+	}
+	return *debugNamespace
+}
+
+// Name of the debug pod and of the PVC temporarily binding the PV
+func debugName(pvName string) string {
+	return "debug-" + pvName
+}
+
+func runInspect(args []string) {
+	if len(args) != 1 {
+		klog.Fatalf("ERROR: usage: inspect <pv>")
+	}
+	persV, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Get(args[0], meta_v1.GetOptions{})
+	if err != nil {
+		klog.Fatalf("ERROR: getting PV %s - %v", args[0], err)
+	}
+	if pvReclaimWasRequested(*persV) {
+		klog.Fatalf("ERROR: PV %s is being deleted", persV.Name)
+	}
+	if binding, ok := getTemporaryBinding(*persV); ok {
+		klog.Fatalf("ERROR: PV %s is already bound temporarily for %s since %s", persV.Name, binding.Purpose, binding.Since.Format(time.RFC3339))
+	}
+	namespace := getDebugNamespace()
+	if err := bindPVTemporarily(*persV, temporaryBindingDebug, namespace, debugName(persV.Name)); err != nil {
+		klog.Fatalf("ERROR: binding PV %s temporarily - %v", persV.Name, err)
+	}
+	defer endDebugSession(persV.Name)
+
+	pod, err := kubeclient.kubeclient.CoreV1().Pods(namespace).Create(debugPod(*persV, namespace))
+	if err != nil {
+		klog.Errorf("ERROR: creating the debug pod of PV %s - %v", persV.Name, err)
+		return
+	}
+	if !waitForDebugPod(pod) {
+		return
+	}
+
+	fmt.Printf("PV %s is mounted read-only in /data of pod %s/%s until %s. Open a shell with:\n\n", persV.Name, namespace, pod.Name,
+		time.Now().Add(*debugTimeout).Format(time.RFC3339))
+	fmt.Printf("    kubectl exec -it -n %s %s -- sh\n\n", namespace, pod.Name)
+	fmt.Printf("Press Enter to end the inspection and release the PV again.\n")
+
+	done := make(chan struct{})
+	go func() {
+		bufio.NewReader(os.Stdin).ReadString('\n')
+		close(done)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-signals:
+			return
+		case <-ticker.C:
+			current, err := kubeclient.kubeclient.CoreV1().Pods(namespace).Get(pod.Name, meta_v1.GetOptions{})
+			if api_errors.IsNotFound(err) || (err == nil && (current.Status.Phase == v1.PodSucceeded || current.Status.Phase == v1.PodFailed)) {
+				fmt.Printf("The debug pod has stopped.\n")
+				return
+			}
+		}
+	}
+}
+
+// A pod mounting the temporary PVC read-only, doing nothing until debugTimeout
+func debugPod(persV v1.PersistentVolume, namespace string) *v1.Pod {
+	activeDeadlineSeconds := int64(debugTimeout.Seconds())
+	return &v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      debugName(persV.Name),
+			Namespace: namespace,
+			Labels:    map[string]string{managedByLabel: managedByValue},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy:         v1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &activeDeadlineSeconds,
+			Containers: []v1.Container{{
+				Name:         "debug",
+				Image:        *debugImage,
+				Command:      []string{"sleep", fmt.Sprint(activeDeadlineSeconds)},
+				WorkingDir:   "/data",
+				VolumeMounts: []v1.VolumeMount{{Name: "data", MountPath: "/data", ReadOnly: true}},
+			}},
+			Volumes: []v1.Volume{{
+				Name: "data",
+				VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+					ClaimName: debugName(persV.Name),
+					ReadOnly:  true,
+				}},
+			}},
+		},
+	}
+}
+
+// Waits for the debug pod to run. Returns false if it does not within a few minutes.
+func waitForDebugPod(pod *v1.Pod) bool {
+	fmt.Printf("Waiting for pod %s/%s to start...\n", pod.Namespace, pod.Name)
+	for deadline := time.Now().Add(5 * time.Minute); time.Now().Before(deadline); time.Sleep(2 * time.Second) {
+		current, err := kubeclient.kubeclient.CoreV1().Pods(pod.Namespace).Get(pod.Name, meta_v1.GetOptions{})
+		if err != nil {
+			klog.Errorf("ERROR: getting pod %s/%s - %v", pod.Namespace, pod.Name, err)
+			return false
+		}
+		switch current.Status.Phase {
+		case v1.PodRunning:
+			return true
+		case v1.PodSucceeded, v1.PodFailed:
+			klog.Errorf("ERROR: pod %s/%s stopped: %s", pod.Namespace, pod.Name, current.Status.Message)
+			return false
+		}
+	}
+	klog.Errorf("ERROR: pod %s/%s did not start within 5m", pod.Namespace, pod.Name)
+	return false
+}
+
+// Deletes the debug pod and waits for the PV to get its original claimRef back
+func endDebugSession(pvName string) {
+	fmt.Printf("Releasing PV %s...\n", pvName)
+	deleteDebugPod(pvName)
+	for deadline := time.Now().Add(5 * time.Minute); time.Now().Before(deadline); time.Sleep(2 * time.Second) {
+		persV, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Get(pvName, meta_v1.GetOptions{})
+		if err != nil {
+			klog.Errorf("ERROR: getting PV %s - %v", pvName, err)
+			continue
+		}
+		released, err := releaseTemporaryBinding(*persV)
+		if err != nil {
+			klog.Errorf("ERROR: ending the temporary binding of PV %s - %v", pvName, err)
+			continue
+		}
+		if released {
+			fmt.Printf("PV %s is Released again, its deletion timestamp is unchanged.\n", pvName)
+			return
+		}
+	}
+	klog.Errorf("ERROR: PV %s is still bound temporarily, the next run of the reclaimer will release it after -debugTimeout", pvName)
+}
+
+func deleteDebugPod(pvName string) {
+	namespace := getDebugNamespace()
+	gracePeriodSeconds := int64(0)
+	err := kubeclient.kubeclient.CoreV1().Pods(namespace).Delete(debugName(pvName), &meta_v1.DeleteOptions{GracePeriodSeconds: &gracePeriodSeconds})
+	if err != nil && !api_errors.IsNotFound(err) {
+		klog.Errorf("ERROR: deleting pod %s/%s - %v", namespace, debugName(pvName), err)
+	}
+}
+
+// Ends the temporary bindings of the inspect commands that were interrupted, once their debug pod stopped
+func releaseStaleDebugBindings(pvs []v1.PersistentVolume) {
+	for _, persV := range pvs {
+		binding, ok := getTemporaryBinding(persV)
+		if !ok || binding.Purpose != temporaryBindingDebug || time.Since(binding.Since) < *debugTimeout+time.Minute {
+			continue
+		}
+		klog.Infof("INFO: ending the temporary binding of PV %s left by an interrupted inspect command", persV.Name)
+		deleteDebugPod(persV.Name)
+		if _, err := releaseTemporaryBinding(persV); err != nil {
+			klog.Errorf("ERROR: ending the temporary binding of PV %s - %v", persV.Name, err)
+		}
+	}
+}
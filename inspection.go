@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	batch_v1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Whether a Released volume actually holds data: a Job, in an admin namespace, mounts it read-only through a temporary
+// binding (see temporary_binding.go) and reports its file count and bytes used. The result is recorded on the PV, for
+// the report and for the policy deleting empty volumes without grace period. Each PV is inspected once.
+
+const (
+	annotationInspectedAt     = "reclaim-volumes.cern.ch/inspected-at"
+	annotationContentFiles    = "reclaim-volumes.cern.ch/content-files"
+	annotationContentBytes    = "reclaim-volumes.cern.ch/content-bytes"
+	annotationInspectionError = "reclaim-volumes.cern.ch/inspection-error"
+)
+
+// Writes {"files": <count>, "bytes": <used>} as the termination message of the container. All the entries count, not
+// only the regular files: a volume with only directories, symlinks or special files is not empty. If find or du fail
+// (e.g. an entry cannot be read), the container fails with their errors as termination message, the content is unknown.
+const inspectionScript = `fail() { { echo "$1 failed:"; head -c 2000 /tmp/errors; } > /dev/termination-log; exit 1; }
+files=$( { find /data -xdev -mindepth 1 2>/tmp/errors || echo $? > /tmp/status; } | wc -l)
+[ ! -e /tmp/status ] && [ ! -s /tmp/errors ] || fail find
+kib=$( { du -sxk /data 2>/tmp/errors || echo $? > /tmp/status; } | cut -f1)
+[ ! -e /tmp/status ] && [ ! -s /tmp/errors ] || fail du
+printf '{"files": %d, "bytes": %d}' "$files" "$((kib * 1024))" > /dev/termination-log
+`
+
+var (
+	inspectVolumes           = flag.Bool("inspectVolumes", false, "inspect the content of Released PVs with a Job once they are released")
+	inspectionNamespace      = flag.String("inspectionNamespace", "", "namespace of the inspection Jobs and of the PVCs temporarily binding the inspected PVs. The namespace of the reclaimer if empty")
+	inspectionImage          = flag.String("inspectionImage", "busybox", "image of the inspection Jobs, with sh, find, du and wc")
+	inspectionTimeout        = flag.Duration("inspectionTimeout", time.Hour, "inspection Jobs not completed after this are stopped and the inspection fails")
+	inspectionMaxConcurrent  = flag.Int("inspectionMaxConcurrent", 2, "maximum number of PVs inspected at the same time")
+	inspectionStorageClasses = flag.String("inspectionStorageClasses", "", "comma-separated StorageClasses whose PVs are inspected. All if empty")
+	reclaimEmptyVolumes      = flag.Bool("reclaimEmptyVolumes", false, "delete the Released PVs that an inspection found empty (no files) without grace period")
+)
+
+// What an inspection Job reports
+type volumeContent struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func getInspectionNamespace() string {
+	if *inspectionNamespace == "" {
+		return currentNamespace()
+	}
+	return *inspectionNamespace
+}
+
+// Name of the inspection Job and of the PVC temporarily binding the PV
+func inspectionName(persV v1.PersistentVolume) string {
+	return "inspect-" + persV.Name
+}
+
+// Moves the running inspections forward and starts new ones, up to inspectionMaxConcurrent
+func processInspections() error {
+	if !*inspectVolumes {
+		return nil
+	}
+	pvList, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	running := 0
+	candidates := []v1.PersistentVolume{}
+	for _, persV := range pvList.Items {
+		if binding, ok := getTemporaryBinding(persV); ok {
+			if binding.Purpose == temporaryBindingInspection {
+				running++
+				advanceInspection(persV, binding)
+			}
+			continue
+		}
+		if volumeNeedsInspection(persV) {
+			candidates = append(candidates, persV)
+		}
+	}
+	for _, persV := range candidates {
+		if running >= *inspectionMaxConcurrent {
+			break
+		}
+		if err := startInspection(persV); err != nil {
+			klog.Errorf("ERROR: starting the inspection of PV %s - %v", persV.Name, err)
+			continue
+		}
+		running++
+	}
+	return nil
+}
+
+// Released PVs that are to be reclaimed after a grace period that is not over
+func volumeNeedsInspection(persV v1.PersistentVolume) bool {
+	if persV.Status.Phase != v1.VolumeReleased || persV.Spec.ClaimRef == nil || persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+		return false
+	}
+	if _, ok := persV.ObjectMeta.Annotations[annotationInspectedAt]; ok {
+		return false
+	}
+	if storageClasses := splitList(*inspectionStorageClasses); len(storageClasses) > 0 && !stringInList(persV.Spec.StorageClassName, storageClasses) {
+		return false
+	}
+	if getPVReclaimingGracePeriod(persV) == 0 || pvCanBeReclaimedImmediately(persV) || pvCanBeReclaimedNeverMounted(persV) {
+		return false
+	}
+	// only set once the PV was processed as Released, and nothing to gain once it is over
+	tDelete, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationDelete])
+	return err == nil && time.Now().Before(tDelete)
+}
+
+func startInspection(persV v1.PersistentVolume) error {
+	klog.Infof("INFO: inspecting the content of PV %s", persV.Name)
+	if err := bindPVTemporarily(persV, temporaryBindingInspection, getInspectionNamespace(), inspectionName(persV)); err != nil {
+		return err
+	}
+	// retried at the next run if it fails
+	return createInspectionJob(persV)
+}
+
+func createInspectionJob(persV v1.PersistentVolume) error {
+	backoffLimit := int32(1)
+	activeDeadlineSeconds := int64(inspectionTimeout.Seconds())
+	job := &batch_v1.Job{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      inspectionName(persV),
+			Namespace: getInspectionNamespace(),
+			Labels:    map[string]string{managedByLabel: managedByValue},
+		},
+		Spec: batch_v1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &activeDeadlineSeconds,
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					RestartPolicy: v1.RestartPolicyNever,
+					Containers: []v1.Container{{
+						Name:         "inspect",
+						Image:        *inspectionImage,
+						Command:      []string{"sh", "-c", inspectionScript},
+						VolumeMounts: []v1.VolumeMount{{Name: "data", MountPath: "/data", ReadOnly: true}},
+					}},
+					Volumes: []v1.Volume{{
+						Name: "data",
+						VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+							ClaimName: inspectionName(persV),
+							ReadOnly:  true,
+						}},
+					}},
+				},
+			},
+		},
+	}
+	if _, err := kubeclient.kubeclient.BatchV1().Jobs(job.Namespace).Create(job); err != nil && !api_errors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating Job %s/%s - %v", job.Namespace, job.Name, err)
+	}
+	return nil
+}
+
+// Records the result of the inspection Job once it is over, then removes the Job and the temporary binding
+func advanceInspection(persV v1.PersistentVolume, binding temporaryBinding) {
+	if _, inspected := persV.ObjectMeta.Annotations[annotationInspectedAt]; !inspected {
+		job, err := kubeclient.kubeclient.BatchV1().Jobs(getInspectionNamespace()).Get(inspectionName(persV), meta_v1.GetOptions{})
+		if api_errors.IsNotFound(err) && time.Since(binding.Since) < *inspectionTimeout {
+			if err := createInspectionJob(persV); err != nil {
+				klog.Errorf("ERROR: inspecting PV %s - %v", persV.Name, err)
+			}
+			return
+		} else if err != nil && !api_errors.IsNotFound(err) {
+			klog.Errorf("ERROR: getting the inspection Job of PV %s - %v", persV.Name, err)
+			return
+		}
+
+		annotations := map[string]string{annotationInspectedAt: time.Now().Format(time.RFC3339)}
+		if err != nil {
+			annotations[annotationInspectionError] = fmt.Sprintf("no inspection Job after %v", *inspectionTimeout)
+		} else if job.Status.Succeeded > 0 {
+			content, err := inspectionResult(*job)
+			if err != nil {
+				annotations[annotationInspectionError] = err.Error()
+			} else {
+				annotations[annotationContentFiles] = strconv.FormatInt(content.Files, 10)
+				annotations[annotationContentBytes] = strconv.FormatInt(content.Bytes, 10)
+			}
+		} else if message, failed := jobFailed(*job); failed {
+			if reason := inspectionFailure(*job); reason != "" {
+				message += " - " + reason
+			}
+			annotations[annotationInspectionError] = message
+		} else if time.Since(binding.Since) > *inspectionTimeout+*resyncPeriod {
+			// e.g. the temporary PVC never got bound
+			annotations[annotationInspectionError] = fmt.Sprintf("not completed after %v", *inspectionTimeout)
+		} else {
+			return
+		}
+		if message, ok := annotations[annotationInspectionError]; ok {
+			klog.Errorf("ERROR: inspection of PV %s failed - %s", persV.Name, message)
+		} else {
+			klog.Infof("INFO: PV %s holds %s file(s), %s bytes", persV.Name, annotations[annotationContentFiles], annotations[annotationContentBytes])
+		}
+		if err := setPVAnnotations(persV.Name, annotations); err != nil {
+			klog.Errorf("ERROR: recording the inspection of PV %s - %v", persV.Name, err)
+			return
+		}
+		summary.InspectedVolumes++
+	}
+
+	propagation := meta_v1.DeletePropagationBackground
+	err := kubeclient.kubeclient.BatchV1().Jobs(getInspectionNamespace()).Delete(inspectionName(persV), &meta_v1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !api_errors.IsNotFound(err) {
+		klog.Errorf("ERROR: deleting the inspection Job of PV %s - %v", persV.Name, err)
+		return
+	}
+	if _, err := releaseTemporaryBinding(persV); err != nil {
+		klog.Errorf("ERROR: ending the temporary binding of PV %s - %v", persV.Name, err)
+	}
+}
+
+func jobFailed(job batch_v1.Job) (string, bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batch_v1.JobFailed && condition.Status == v1.ConditionTrue {
+			return fmt.Sprintf("Job %s failed: %s %s", job.Name, condition.Reason, condition.Message), true
+		}
+	}
+	return "", false
+}
+
+// The content reported by the succeeded pod of an inspection Job
+func inspectionResult(job batch_v1.Job) (volumeContent, error) {
+	content := volumeContent{}
+	podList, err := kubeclient.kubeclient.CoreV1().Pods(job.Namespace).List(meta_v1.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		return content, fmt.Errorf("listing the pods of Job %s - %v", job.Name, err)
+	}
+	for _, pod := range podList.Items {
+		if pod.Status.Phase != v1.PodSucceeded {
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated == nil {
+				continue
+			}
+			if err := json.Unmarshal([]byte(status.State.Terminated.Message), &content); err != nil {
+				return content, fmt.Errorf("invalid result of Job %s '%s' - %v", job.Name, status.State.Terminated.Message, err)
+			}
+			return content, nil
+		}
+	}
+	return content, fmt.Errorf("no result found for Job %s", job.Name)
+}
+
+// Why the pods of a failed inspection Job failed, e.g. the permission errors of find, if they said
+func inspectionFailure(job batch_v1.Job) string {
+	podList, err := kubeclient.kubeclient.CoreV1().Pods(job.Namespace).List(meta_v1.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		return ""
+	}
+	for _, pod := range podList.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Terminated != nil && status.State.Terminated.ExitCode != 0 && status.State.Terminated.Message != "" {
+				return status.State.Terminated.Message
+			}
+		}
+	}
+	return ""
+}
+
+// The content of a PV found by its inspection, if it was inspected successfully
+func pvContent(persV v1.PersistentVolume) (volumeContent, bool) {
+	files, err := strconv.ParseInt(persV.ObjectMeta.Annotations[annotationContentFiles], 10, 64)
+	if err != nil {
+		return volumeContent{}, false
+	}
+	bytes, err := strconv.ParseInt(persV.ObjectMeta.Annotations[annotationContentBytes], 10, 64)
+	if err != nil {
+		return volumeContent{}, false
+	}
+	return volumeContent{Files: files, Bytes: bytes}, true
+}
+
+// Whether a Released PV can be deleted without grace period because its inspection found it empty
+func pvCanBeReclaimedEmpty(persV v1.PersistentVolume) bool {
+	if !*reclaimEmptyVolumes || getPVReclaimingGracePeriod(persV) == 0 {
+		// be conservative: only reclaim volumes that have a valid annotationPeriodReclaimVolumesAfterRelease
+		return false
+	}
+	if _, ok := persV.ObjectMeta.Annotations[annotationRetentionExtendedBy]; ok {
+		// a user explicitly asked to keep this volume longer
+		return false
+	}
+	content, ok := pvContent(persV)
+	return ok && content.Files == 0
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+// pvCanBeReclaimedImmediately limits the damage of PVCs created and deleted in a loop (OTG0048218, INC1973961) but
+// does not tell anybody. The short-lived volumes seen during the last -loopDetectionWindow are remembered in a ConfigMap,
+// and many of them in the same namespace and StorageClass with the same claim name or owner are reported as a loop.
+
+// set on a namespace where a loop was detected, so that an admission policy can block provisioning there
+const annotationLoopDetected = "reclaim-volumes.cern.ch/pvc-loop-detected"
+
+var (
+	loopDetectionThreshold  = flag.Int("loopDetectionThreshold", 0, "number of short-lived PVs with the same namespace, StorageClass and claim name or owner within -loopDetectionWindow that is reported as a create/delete loop. Disabled if 0")
+	loopDetectionWindow     = flag.Duration("loopDetectionWindow", time.Hour, "time window of the loop detection")
+	loopShortLivedThreshold = flag.Duration("loopShortLivedThreshold", 10*time.Minute, "a PV released less than this after its creation counts as short-lived for the loop detection")
+	loopStateConfigMap      = flag.String("loopStateConfigMap", "reclaim-volumes-loop-state", "ConfigMap, in the namespace of the reclaimer, remembering the short-lived PVs of the loop detection window")
+	loopAnnotateNamespace   = flag.Bool("loopAnnotateNamespace", false, "annotate the namespaces where a loop is detected with "+annotationLoopDetected)
+)
+
+// A PV released shortly after its creation
+type shortLivedVolume struct {
+	PersistentVolume string    `json:"persistentVolume"`
+	Namespace        string    `json:"namespace"`
+	StorageClass     string    `json:"storageClass"`
+	ClaimName        string    `json:"claimName"`
+	Owner            string    `json:"owner,omitempty"`
+	ReleasedAt       time.Time `json:"releasedAt"`
+}
+
+// What is remembered between runs
+type loopState struct {
+	Volumes []shortLivedVolume `json:"volumes"`
+	// when each loop was last alerted, to raise one event per window
+	Alerted map[string]time.Time `json:"alerted"`
+	// the namespaces annotated with annotationLoopDetected, to remove it once their loops stop
+	Annotated map[string]time.Time `json:"annotated,omitempty"`
+}
+
+// Many short-lived PVs with something in common
+type volumeLoop struct {
+	Namespace    string   `json:"namespace"`
+	StorageClass string   `json:"storageClass"`
+	ClaimName    string   `json:"claimName,omitempty"`
+	Owner        string   `json:"owner,omitempty"`
+	Count        int      `json:"count"`
+	Volumes      []string `json:"volumes"`
+}
+
+func (loop volumeLoop) key() string {
+	return loop.Namespace + "/" + loop.StorageClass + "/" + loop.ClaimName + "/" + loop.Owner
+}
+
+func (loop volumeLoop) String() string {
+	what := "claim name " + loop.ClaimName
+	if loop.Owner != "" {
+		what = "owner " + loop.Owner
+	}
+	return fmt.Sprintf("%d PVs of StorageClass %s with %s were released less than %v after their creation within %v",
+		loop.Count, loop.StorageClass, what, *loopShortLivedThreshold, *loopDetectionWindow)
+}
+
+func loadLoopState() loopState {
+	state := loopState{Alerted: map[string]time.Time{}, Annotated: map[string]time.Time{}}
+	configMap, err := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Get(*loopStateConfigMap, meta_v1.GetOptions{})
+	if err != nil {
+		if !api_errors.IsNotFound(err) {
+			klog.Errorf("ERROR: reading loop detection state - %v", err)
+		}
+		return state
+	}
+	if err := json.Unmarshal([]byte(configMap.Data["state"]), &state); err != nil {
+		klog.Errorf("ERROR: invalid loop detection state in ConfigMap %s - %v", *loopStateConfigMap, err)
+	}
+	if state.Alerted == nil {
+		state.Alerted = map[string]time.Time{}
+	}
+	if state.Annotated == nil {
+		state.Annotated = map[string]time.Time{}
+	}
+	return state
+}
+
+func saveLoopState(state loopState) {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	configMaps := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace())
+	configMap, err := configMaps.Get(*loopStateConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: *loopStateConfigMap, Labels: map[string]string{managedByLabel: managedByValue}}}
+		configMap.Data = map[string]string{"state": string(value)}
+		_, err = configMaps.Create(configMap)
+	} else if err == nil {
+		configMap.Data = map[string]string{"state": string(value)}
+		_, err = configMaps.Update(configMap)
+	}
+	if err != nil {
+		klog.Errorf("ERROR: saving loop detection state - %v", err)
+	}
+}
+
+// Adds the short-lived Released PVs to the state and forgets the ones released before the window
+func updateLoopState(state loopState, pvs []v1.PersistentVolume, now time.Time) loopState {
+	known := map[string]bool{}
+	volumes := []shortLivedVolume{}
+	for _, volume := range state.Volumes {
+		if now.Sub(volume.ReleasedAt) <= *loopDetectionWindow {
+			volumes = append(volumes, volume)
+			known[volume.PersistentVolume] = true
+		}
+	}
+	for _, persV := range pvs {
+		if persV.Status.Phase != v1.VolumeReleased || persV.Spec.ClaimRef == nil || known[persV.Name] {
+			continue
+		}
+		releasedAt := releasedAtOrNow(persV, now)
+		if now.Sub(releasedAt) > *loopDetectionWindow {
+			continue
+		}
+		// the volumes reclaimed immediately are short-lived too, whatever the time between the runs
+		if releasedAt.Sub(persV.CreationTimestamp.Time) >= *loopShortLivedThreshold && !pvCanBeReclaimedImmediately(persV) {
+			continue
+		}
+		volumes = append(volumes, shortLivedVolume{
+			PersistentVolume: persV.Name,
+			Namespace:        persV.Spec.ClaimRef.Namespace,
+			StorageClass:     persV.Spec.StorageClassName,
+			ClaimName:        persV.Spec.ClaimRef.Name,
+			Owner:            getClaimMetadata(persV).ClaimOwner,
+			ReleasedAt:       releasedAt,
+		})
+	}
+	state.Volumes = volumes
+	for key, alerted := range state.Alerted {
+		if now.Sub(alerted) > *loopDetectionWindow {
+			delete(state.Alerted, key)
+		}
+	}
+	return state
+}
+
+// Groups the short-lived volumes by namespace, StorageClass and claim name or owner, and returns the groups with at
+// least loopDetectionThreshold volumes
+func detectVolumeLoops(volumes []shortLivedVolume) []volumeLoop {
+	groups := map[string]*volumeLoop{}
+	add := func(loop volumeLoop, pvName string) {
+		if groups[loop.key()] == nil {
+			groups[loop.key()] = &loop
+		}
+		groups[loop.key()].Count++
+		groups[loop.key()].Volumes = append(groups[loop.key()].Volumes, pvName)
+	}
+	for _, volume := range volumes {
+		add(volumeLoop{Namespace: volume.Namespace, StorageClass: volume.StorageClass, ClaimName: volume.ClaimName}, volume.PersistentVolume)
+		if volume.Owner != "" {
+			add(volumeLoop{Namespace: volume.Namespace, StorageClass: volume.StorageClass, Owner: volume.Owner}, volume.PersistentVolume)
+		}
+	}
+	loops := []volumeLoop{}
+	for _, loop := range groups {
+		if loop.Count >= *loopDetectionThreshold {
+			loops = append(loops, *loop)
+		}
+	}
+	sort.Slice(loops, func(i, j int) bool { return loops[i].key() < loops[j].key() })
+	return loops
+}
+
+// Detects create/delete loops from the PVs of the run, raises an event on their namespace and optionally annotates it
+func detectLoops(pvs []v1.PersistentVolume) {
+	if *loopDetectionThreshold <= 0 {
+		return
+	}
+	now := time.Now()
+	state := updateLoopState(loadLoopState(), pvs, now)
+	loops := detectVolumeLoops(state.Volumes)
+	looping := map[string]bool{}
+	for _, loop := range loops {
+		looping[loop.Namespace] = true
+		summary.LoopsDetected++
+		klog.Warningf("WARNING: create/delete loop in namespace %s: %v", loop.Namespace, loop)
+		if _, ok := state.Alerted[loop.key()]; ok {
+			continue
+		}
+		state.Alerted[loop.key()] = now
+		recordNamespaceEvent(loop.Namespace, v1.EventTypeWarning, "VolumeLoopDetected", loop.String())
+		if *loopAnnotateNamespace && annotateLoopNamespace(loop.Namespace, loopAnnotationValue(loop, now)) {
+			state.Annotated[loop.Namespace] = now
+		}
+	}
+	// no loop within the window any more: new PVCs can be provisioned there again
+	for namespace := range state.Annotated {
+		if !looping[namespace] && annotateLoopNamespace(namespace, "") {
+			klog.Infof("INFO: no create/delete loop in namespace %s within %v, removing its %s annotation", namespace, *loopDetectionWindow, annotationLoopDetected)
+			delete(state.Annotated, namespace)
+		}
+	}
+	saveLoopState(state)
+}
+
+func loopAnnotationValue(loop volumeLoop, now time.Time) string {
+	value, _ := json.Marshal(map[string]string{"detected": now.Format(time.RFC3339), "storageClass": loop.StorageClass, "reason": loop.String()})
+	return string(value)
+}
+
+// Sets annotationLoopDetected on a namespace, or removes it if value is empty. Returns false if that must be retried.
+func annotateLoopNamespace(namespace, value string) bool {
+	annotation := map[string]interface{}{annotationLoopDetected: nil}
+	if value != "" {
+		annotation[annotationLoopDetected] = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotation}})
+	if err != nil {
+		return false
+	}
+	if _, err := kubeclient.kubeclient.CoreV1().Namespaces().Patch(namespace, types.StrategicMergePatchType, patch); err != nil && !api_errors.IsNotFound(err) {
+		klog.Errorf("ERROR: annotating namespace %s - %v", namespace, err)
+		return false
+	}
+	return true
+}
+
+// The loops of the current window, for the report (nothing is recorded)
+func currentVolumeLoops(pvs []v1.PersistentVolume, now time.Time) []volumeLoop {
+	if *loopDetectionThreshold <= 0 {
+		return nil
+	}
+	return detectVolumeLoops(updateLoopState(loadLoopState(), pvs, now).Volumes)
+}
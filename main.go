@@ -2,10 +2,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"time"
 
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
 )
 
@@ -32,15 +33,30 @@ func pvGracePeriodHasExpired(persV v1.PersistentVolume) bool {
 	return false
 }
 
-func requestPVDeletion(persV v1.PersistentVolume) {
+// Sets the reclaim policy of a PV to Delete unless a deletion guard blocks it. Returns whether the deletion was requested.
+func requestPVDeletion(persV v1.PersistentVolume, trigger, reason string) bool {
+	if pvDeletionIsBlocked(persV, trigger) {
+		return false
+	}
 	reclaimPolicy := "Delete"
-	if err := patchPVReclaimingPolicy(persV.Name, reclaimPolicy); err == nil {
+	if err := patchPVReclaimingPolicy(persV, reclaimPolicy, reason); err == nil {
 		klog.Infof("INFO: PV '%s' reclaimPolicy set to %s!", persV.Name, reclaimPolicy)
+		if persV.Status.Phase == v1.VolumeBound {
+			// the claim of this PV is missing: the PV controller only deletes Released PVs
+			patchPVPhaseReleased(persV.Name)
+		}
+		summary.DeletionsRequested++
+		// remember when, to detect PVs the provisioner fails to delete
+		setPVAnnotations(persV.Name, map[string]string{annotationReclaimRequested: time.Now().Format(time.RFC3339)})
+		queueNotification(persV, notificationDeleted, persV.ObjectMeta.Annotations[annotationDelete])
+		return true
 	}
+	return false
 }
 
-
-// 0 duration means no reclaiming policy
+// 0 duration means no reclaiming policy.
+// For PVs with a reclaiming policy, an override annotation or the capacity policy can replace the annotation's grace period,
+// and PVs unused for a long time before their release can get a shorter one.
 func getPVReclaimingGracePeriod(persV v1.PersistentVolume) time.Duration {
 	reclaimPolicyDuration, err := time.ParseDuration(persV.ObjectMeta.Annotations[annotationPeriodReclaimVolumesAfterRelease])
 
@@ -53,10 +69,19 @@ func getPVReclaimingGracePeriod(persV v1.PersistentVolume) time.Duration {
 		return 0
 	}
 
+	if override := gracePeriodOverride(persV); override > 0 {
+		return override
+	}
+	if scaled, _ := capacityScaledGracePeriod(persV); scaled > 0 {
+		reclaimPolicyDuration = scaled
+	}
+	if unused := unusedVolumeGracePeriod(persV); unused > 0 && unused < reclaimPolicyDuration {
+		return unused
+	}
+
 	return reclaimPolicyDuration
 }
 
-
 // for PVs that should be reclaimed after a grace period (as indicated by the annotationPeriodReclaimVolumesAfterRelease annotation),
 // calculate the grace period and set it on the PV (via annotation annotationDelete).
 // Does nothing if annotationDelete is already present or annotationPeriodReclaimVolumesAfterRelease is not set.
@@ -77,11 +102,13 @@ func setPVGracePeriod(persV v1.PersistentVolume) {
 	tFutureDeletionPV := time.Now().Add(reclaimingGracePeriod)
 
 	klog.Infof("INFO: Setting annotation on PV %s so it is deleted after %v", persV.Name, tFutureDeletionPV)
-	err := setPVDateAnnotation(persV.Name, annotationDelete, tFutureDeletionPV)
+	err := setPVDateAnnotation(persV, annotationDelete, tFutureDeletionPV, fmt.Sprintf("released, grace period of %v", reclaimingGracePeriod))
 	if err != nil {
 		klog.Errorf("ERROR: patching PV %s with annotation %s %v", persV.Name, annotationDelete, tFutureDeletionPV)
 		return
 	}
+	summary.GracePeriodsSet++
+	queueNotification(persV, notificationScheduled, tFutureDeletionPV.Format(time.RFC3339))
 }
 
 // If a volume is Released very quickly after it was created, assume we can delete it immediately. It's unlikely to have any useful content.
@@ -94,6 +121,11 @@ func pvCanBeReclaimedImmediately(persV v1.PersistentVolume) bool {
 		return false
 	}
 
+	if _, ok := persV.ObjectMeta.Annotations[annotationRetentionExtendedBy]; ok {
+		// a user explicitly asked to keep this volume longer
+		return false
+	}
+
 	maximumAgeForImmediateReclaiming, err := time.ParseDuration(persV.ObjectMeta.Annotations[annotationNoGracePeriodSinceCreation])
 
 	if err != nil {
@@ -111,40 +143,178 @@ func pvCanBeReclaimedImmediately(persV v1.PersistentVolume) bool {
 	return time.Now().Before(deadLineForImmediateReclaiming)
 }
 
-
-func main() {
-
-	// Initializing global flags for klog
-	klog.InitFlags(nil)
-
-	// Called it to parse the command line into the defined flags
-	flag.Parse()
-
+// Processes *all* Released persistent volumes once: deletes the ones whose grace period has expired (or that can be
+// reclaimed immediately) and sets a grace period on the others.
+func reclaimReleasedVolumes() error {
 	// List *all* persistent volumes
 	pvList, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
 	if err != nil {
-		klog.Fatalf("ERROR: Impossible to retrieve the list of all persistent volumes - %v", err)
+		return err
 	}
+	summary = runSummary{}
+	indexBackends(pvList.Items)
+	resetVolumeUsage()
+	resetNamespaces()
+	detectLoops(pvList.Items)
+	enforceNamespaceLimits(pvList.Items)
+	preparePressureReclaims(pvList.Items)
 
 	for _, persV := range pvList.Items {
-		// Reclaiming volumes only makes sense for PVs that have been Released
-		if persV.Status.Phase == "Released" {
-			if pvCanBeReclaimedImmediately(persV) {
+		// their claimRef is not the one of their former PVC for now, see temporary_binding.go
+		if _, ok := getTemporaryBinding(persV); ok {
+			continue
+		}
+		// being bound again to a restored PVC, see restore_requests.go
+		if checkRestoringVolume(persV) {
+			continue
+		}
+
+		// counted and alerted even when we set them to Delete ourselves
+		if persV.Status.Phase == v1.VolumeFailed {
+			handleFailedVolume(persV)
+			// retry-delete already re-triggers the deletion of the Failed PVs set to Delete
+			if pvReclaimWasRequested(persV) && *failedVolumePolicy != failedVolumePolicyRetryDelete {
+				checkStuckReclaim(persV)
+			}
+			continue
+		}
+
+		// PVs we already set to Delete: only make sure they actually go away
+		if pvReclaimWasRequested(persV) {
+			checkStuckReclaim(persV)
+			continue
+		}
+
+		// Reclaiming volumes only makes sense for PVs that have been Released (or whose claim is gone)
+		claimMissing := checkMissingClaim(persV)
+		if persV.Status.Phase == "Released" || claimMissing {
+			if !claimMissing {
+				summary.ReleasedVolumes++
+			}
+			markPVReleased(persV)
+			reportStaleAttachments(persV)
+			if !claimMissing && pvCanBeReclaimedImmediately(persV) {
 				klog.Infof("INFO: deleting PersistentVolume %s immediately as it does have the minimum age to apply grace period", persV.Name)
-				requestPVDeletion(persV)
+				requestPVDeletion(persV, deletionTriggerImmediate, fmt.Sprintf("released less than %s after creation", persV.ObjectMeta.Annotations[annotationNoGracePeriodSinceCreation]))
 				// nothing else to do for this PV
 				continue
 			}
 
+			if !claimMissing && pvCanBeReclaimedNeverMounted(persV) {
+				klog.Infof("INFO: deleting PersistentVolume %s immediately as it was never mounted", persV.Name)
+				requestPVDeletion(persV, deletionTriggerImmediate, "never mounted")
+				continue
+			}
+
+			if !claimMissing && pvCanBeReclaimedEmpty(persV) {
+				klog.Infof("INFO: deleting PersistentVolume %s immediately as its inspection found it empty", persV.Name)
+				requestPVDeletion(persV, deletionTriggerImmediate, "empty volume")
+				continue
+			}
+
+			if reason, ok := pressureAccelerations[persV.Name]; ok {
+				klog.Infof("INFO: deleting PersistentVolume %s before the end of its grace period: %s", persV.Name, reason)
+				if requestPVDeletion(persV, deletionTriggerPressure, reason) {
+					summary.AcceleratedDeletions++
+				}
+				continue
+			}
+
 			if pvGracePeriodHasExpired(persV) {
 				klog.Infof("INFO: deleting PersistentVolume %s now since it is at the end of its grace period", persV.Name)
-				requestPVDeletion(persV)
+				requestPVDeletion(persV, deletionTriggerGracePeriodExpired, "grace period expired")
 				// nothing else to do for this PV
 				continue
 			}
 
+			queueReminderIfDue(persV)
 			setPVGracePeriod(persV)
 		}
 	}
-	klog.Infof("All existing PersistentVolumes have been processed")
+	releaseStaleDebugBindings(pvList.Items)
+	// after the PVs were processed, so that none is bound temporarily while its deletion is being requested.
+	// The pre-delete hooks started by the deletion guards are followed there too.
+	if err := processInspections(); err != nil {
+		klog.Errorf("ERROR: inspecting Released PVs - %v", err)
+	}
+	if err := processPreDeleteHooks(); err != nil {
+		klog.Errorf("ERROR: processing pre-delete hooks - %v", err)
+	}
+	klog.Infof("All existing PersistentVolumes have been processed: %v", summary)
+
+	flushNotifications()
+	publishRunMetrics()
+
+	// tell users about their retained volumes, based on the state we just left the PVs in
+	publishPendingDeletionsConfigMaps()
+	return nil
+}
+
+// Default command, meant to be run periodically by a CronJob: process all PVs once and exit
+func runOnce(args []string) {
+	publishPausedState()
+
+	// apply users' requests before deciding what to delete
+	if err := processRetentionExtensionRequests(); err != nil {
+		klog.Errorf("ERROR: processing VolumeRetentionExtensions - %v", err)
+	}
+
+	if err := reclaimReleasedVolumes(); err != nil {
+		klog.Fatalf("ERROR: Impossible to retrieve the list of all persistent volumes - %v", err)
+	}
+}
+
+// Commands supported by the reclaimer, selected by the first positional argument. Without argument, "run" is used.
+var commands = map[string]func(args []string){
+	"run":          runOnce,
+	"controller":   runController,
+	"report":       runReport,
+	"history":      runHistory,
+	"verify-audit": runVerifyAudit,
+	"approve":      runApprove,
+	"inspect":      runInspect,
+	"explain":      runExplain,
+}
+
+// Parses the flags that come after the command name (they can be mixed with positional arguments,
+// e.g. `history my-pv -v 2`) and returns the positional arguments.
+func parseCommandFlags(args []string) []string {
+	positional := []string{}
+	for len(args) > 0 {
+		if err := flag.CommandLine.Parse(args); err != nil {
+			// flag.ExitOnError is set on the command line FlagSet, so this is not reached
+			klog.Fatalf("ERROR: %v", err)
+		}
+		args = flag.Args()
+		if len(args) > 0 {
+			positional = append(positional, args[0])
+			args = args[1:]
+		}
+	}
+	return positional
+}
+
+func main() {
+
+	// Initializing global flags for klog
+	klog.InitFlags(nil)
+
+	// Called it to parse the command line into the defined flags
+	flag.Parse()
+
+	commandName := "run"
+	if flag.NArg() > 0 {
+		commandName = flag.Arg(0)
+	}
+	command, ok := commands[commandName]
+	if !ok {
+		klog.Fatalf("ERROR: unknown command '%s'", commandName)
+	}
+
+	var args []string
+	if flag.NArg() > 1 {
+		args = parseCommandFlags(flag.Args()[1:])
+	}
+	kubeclient = NewKubeClient()
+	command(args)
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+var (
+	metricsPushgatewayURL = flag.String("metricsPushgatewayURL", "", "push the metrics to this Prometheus Pushgateway at the end of each run (e.g. http://pushgateway:9091)")
+	metricsAddress        = flag.String("metricsAddress", "", "in controller mode, serve the metrics for Prometheus on this address (e.g. :8080) at /metrics")
+)
+
+// What happened during one processing of all PVs, logged at the end of the run and exposed as metrics
+type runSummary struct {
+	ReleasedVolumes    int
+	GracePeriodsSet    int
+	DeletionsRequested int
+	StuckReclaims      int
+	RetriedReclaims    int
+	FailedVolumes      int
+	FailedByCategory   map[string]int
+	BlockedDeletions   map[string]int
+	StaleAttachments   int
+	MissingClaims      int
+	// deleted before the end of their grace period because of storage pressure
+	AcceleratedDeletions int
+	// shortened because the namespace of the volume exceeds its limit
+	ShortenedGracePeriods int
+	LoopsDetected         int
+	InspectedVolumes      int
+}
+
+var summary runSummary
+
+func (s runSummary) String() string {
+	return fmt.Sprintf("%d released volume(s), %d grace period(s) set, %d deletion(s) requested, %d stuck reclaim(s), %d reclaim(s) retried, %d failed volume(s) %v, blocked deletions %v, %d stale attachment(s), %d missing claim(s), %d accelerated deletion(s), %d grace period(s) shortened, %d create/delete loop(s), %d volume(s) inspected",
+		s.ReleasedVolumes, s.GracePeriodsSet, s.DeletionsRequested, s.StuckReclaims, s.RetriedReclaims, s.FailedVolumes, s.FailedByCategory, s.BlockedDeletions, s.StaleAttachments, s.MissingClaims, s.AcceleratedDeletions, s.ShortenedGracePeriods, s.LoopsDetected, s.InspectedVolumes)
+}
+
+// A metric with its current value for each set of labels
+type metric struct {
+	help   string
+	values map[string]float64
+}
+
+var (
+	metricsLock sync.Mutex
+	metrics     = map[string]*metric{}
+)
+
+// Sets the value of a gauge. Labels are given as name/value pairs.
+func setGauge(name, help string, value float64, labels ...string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	if metrics[name] == nil {
+		metrics[name] = &metric{help: help, values: map[string]float64{}}
+	}
+	labelPairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelPairs = append(labelPairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	metrics[name].values[strings.Join(labelPairs, ",")] = value
+}
+
+// Writes all the metrics in the Prometheus text format
+func formatMetrics() []byte {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	names := []string{}
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", name, metrics[name].help, name)
+		labelSets := []string{}
+		for labels := range metrics[name].values {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			if labels == "" {
+				fmt.Fprintf(&out, "%s %v\n", name, metrics[name].values[labels])
+			} else {
+				fmt.Fprintf(&out, "%s{%s} %v\n", name, labels, metrics[name].values[labels])
+			}
+		}
+	}
+	return out.Bytes()
+}
+
+// Exposes the summary of the run as metrics and pushes them if a Pushgateway is configured
+func publishRunMetrics() {
+	publishPausedState()
+	setGauge("reclaim_volumes_released_volumes", "Number of Released PVs at the last run", float64(summary.ReleasedVolumes))
+	setGauge("reclaim_volumes_grace_periods_set", "Number of PVs that got a deletion timestamp at the last run", float64(summary.GracePeriodsSet))
+	setGauge("reclaim_volumes_deletions_requested", "Number of PVs whose reclaim policy was set to Delete at the last run", float64(summary.DeletionsRequested))
+	setGauge("reclaim_volumes_stuck_reclaims", "Number of PVs set to Delete that are still present after the stuck reclaim timeout", float64(summary.StuckReclaims))
+	for _, category := range allFailedVolumeCategories() {
+		setGauge("reclaim_volumes_failed_volumes", "Number of PVs in the Failed phase, by failure category", float64(summary.FailedByCategory[category]), "category", category)
+	}
+	for _, guard := range allDeletionGuards() {
+		setGauge("reclaim_volumes_blocked_deletions", "Number of PVs whose deletion was blocked at the last run, by guard", float64(summary.BlockedDeletions[guard]), "guard", guard)
+	}
+	setGauge("reclaim_volumes_stale_attachments", "Number of VolumeAttachments of Released PVs older than the stale attachment threshold", float64(summary.StaleAttachments))
+	setGauge("reclaim_volumes_missing_claims", "Number of Bound PVs whose claim has been missing for longer than the missing claim threshold", float64(summary.MissingClaims))
+	setGauge("reclaim_volumes_accelerated_deletions", "Number of PVs deleted before the end of their grace period because of storage pressure at the last run", float64(summary.AcceleratedDeletions))
+	setGauge("reclaim_volumes_shortened_grace_periods", "Number of PVs whose grace period was shortened because their namespace exceeds its limit at the last run", float64(summary.ShortenedGracePeriods))
+	setGauge("reclaim_volumes_loops_detected", "Number of create/delete loops of PVCs detected at the last run", float64(summary.LoopsDetected))
+	setGauge("reclaim_volumes_inspected_volumes", "Number of PVs whose content inspection completed at the last run", float64(summary.InspectedVolumes))
+	setGauge("reclaim_volumes_last_run_timestamp_seconds", "Time of the last run", float64(time.Now().Unix()))
+
+	if *metricsPushgatewayURL == "" {
+		return
+	}
+	request, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(*metricsPushgatewayURL, "/")+"/metrics/job/reclaim-cephfs-volumes", bytes.NewReader(formatMetrics()))
+	if err != nil {
+		klog.Errorf("ERROR: pushing metrics - %v", err)
+		return
+	}
+	request.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(request)
+	if err != nil {
+		klog.Errorf("ERROR: pushing metrics - %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		klog.Errorf("ERROR: pushing metrics - Pushgateway returned %s", resp.Status)
+	}
+}
+
+// Serves /metrics in controller mode
+func serveMetrics() {
+	if *metricsAddress == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(formatMetrics())
+	})
+	go func() {
+		klog.Fatalf("ERROR: serving metrics - %v", http.ListenAndServe(*metricsAddress, mux))
+	}()
+}
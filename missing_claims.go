@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// The PV controller is trusted to set the phase of a PV to Released once its PVC is deleted, but PVs have been seen
+// stuck Bound to a PVC that no longer exists (e.g. after an etcd restore). With -detectMissingClaims, the claimRef of
+// each Bound PV is checked against the existing PVCs, and PVs whose claim has been missing for longer than
+// -missingClaimThreshold are reported. They are only reclaimed, like Released PVs, with -reclaimMissingClaims.
+
+// set on a Bound PV when its claim is first found missing, removed if the claim shows up again
+const annotationClaimMissingSince = "reclaim-volumes.cern.ch/claim-missing-since"
+
+var (
+	detectMissingClaims   = flag.Bool("detectMissingClaims", false, "check the claim of Bound PVs still exists, and report the PVs whose claim is missing")
+	missingClaimThreshold = flag.Duration("missingClaimThreshold", 24*time.Hour, "with -detectMissingClaims, how long the claim of a Bound PV must be missing before the PV is considered released")
+	reclaimMissingClaims  = flag.Bool("reclaimMissingClaims", false, "with -detectMissingClaims, reclaim the PVs whose claim is missing like Released PVs")
+)
+
+// Whether the PVC a Bound PV refers to (namespace, name and UID) does not exist
+func claimIsMissing(persV v1.PersistentVolume, claims map[string]v1.PersistentVolumeClaim) bool {
+	claimRef := persV.Spec.ClaimRef
+	if persV.Status.Phase != v1.VolumeBound || claimRef == nil || claimRef.UID == "" {
+		return false
+	}
+	claim, ok := claims[claimRef.Namespace+"/"+claimRef.Name]
+	return !ok || claim.UID != claimRef.UID
+}
+
+// Tracks since when the claim of a Bound PV is missing. Returns whether the PV must be processed as if it was Released.
+func checkMissingClaim(persV v1.PersistentVolume) bool {
+	if !*detectMissingClaims || persV.Status.Phase != v1.VolumeBound {
+		return false
+	}
+	if err := listVolumeUsage(); err != nil {
+		// be conservative: if we cannot tell, the claim is not missing
+		klog.Errorf("ERROR: listing PVCs - %v", err)
+		return false
+	}
+	missingSince, annotated := persV.ObjectMeta.Annotations[annotationClaimMissingSince]
+	if !claimIsMissing(persV, claims) {
+		if annotated {
+			klog.Infof("INFO: the claim of PV %s exists again", persV.Name)
+			setPVAnnotations(persV.Name, map[string]string{annotationClaimMissingSince: ""})
+		}
+		return false
+	}
+	tMissing, err := time.Parse(time.RFC3339, missingSince)
+	if err != nil {
+		klog.Infof("INFO: PV %s is Bound to claim %s/%s (UID %s), which does not exist", persV.Name,
+			persV.Spec.ClaimRef.Namespace, persV.Spec.ClaimRef.Name, persV.Spec.ClaimRef.UID)
+		setPVAnnotations(persV.Name, map[string]string{annotationClaimMissingSince: time.Now().Format(time.RFC3339)})
+		return false
+	}
+	if time.Since(tMissing) < *missingClaimThreshold {
+		return false
+	}
+	summary.MissingClaims++
+	klog.Warningf("WARNING: PV %s is Bound but its claim %s/%s (UID %s) has been missing since %s", persV.Name,
+		persV.Spec.ClaimRef.Namespace, persV.Spec.ClaimRef.Name, persV.Spec.ClaimRef.UID, missingSince)
+	return *reclaimMissingClaims
+}
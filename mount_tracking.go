@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/klog"
+)
+
+// annotationNoGracePeriodSinceCreation is a proxy for "contains no useful data". In controller mode, the reclaimer can
+// instead observe which Bound PVs are mounted by a pod, so that the volumes that were never mounted are deleted without
+// grace period and the ones unused for a long time before their release get a shorter grace period.
+// Pods are watched, so that the ones mounting a volume and gone before the next resync are seen too. The periods when
+// mounts could have been missed (controller not running, watch events lost) are recorded in mountTrackingConfigMap: a
+// PV existing during one of them may have been mounted, it is not considered as never mounted.
+
+const (
+	annotationFirstMounted = "reclaim-volumes.cern.ch/first-mounted"
+	annotationLastMounted  = "reclaim-volumes.cern.ch/last-mounted"
+	// when the reclaimer started observing the mounts of the PV: a PV without annotationFirstMounted was never mounted
+	// only if it was observed since its creation
+	annotationMountTrackingSince = "reclaim-volumes.cern.ch/mount-tracking-since"
+)
+
+var (
+	trackMounts            = flag.Bool("trackMounts", true, "in controller mode, record when Bound PVs are first and last mounted by a pod")
+	lastMountedResolution  = flag.Duration("lastMountedResolution", time.Hour, "how often the "+annotationLastMounted+" annotation of a mounted PV is updated")
+	reclaimNeverMounted    = flag.Bool("reclaimNeverMounted", false, "delete the released PVs that were never mounted without grace period. Only applies to PVs observed since their creation")
+	unusedGracePeriod      = flag.Duration("unusedGracePeriod", 0, "grace period of the PVs that were not mounted during -unusedThreshold before their release, if shorter than their grace period. Disabled if 0")
+	unusedThreshold        = flag.Duration("unusedThreshold", 30*24*time.Hour, "a PV not mounted during this long before its release gets the -unusedGracePeriod")
+	mountTrackingConfigMap = flag.String("mountTrackingConfigMap", "reclaim-volumes-mount-tracking", "ConfigMap in the namespace of the reclaimer recording until when the mounts were observed and the periods they were not")
+)
+
+// At most this many gaps are kept, the oldest are forgotten
+const maxMountObservationGaps = 100
+
+// Until when the reclaimer observed the mounts of the PVs continuously, except during the gaps
+type mountObservation struct {
+	LastObserved time.Time           `json:"lastObserved"`
+	Gaps         []observationPeriod `json:"gaps"`
+	// the gaps before this are not known
+	GapsKnownSince time.Time `json:"gapsKnownSince"`
+}
+
+type observationPeriod struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+var (
+	// loaded once per run, and updated by trackVolumeMounts in controller mode
+	currentMountObservation *mountObservation
+	mountObservationLoaded  bool
+	// gaps of the pod watch not recorded in mountTrackingConfigMap yet, and the start of the current one if the pod
+	// watch is not running now
+	podWatchGaps      []observationPeriod
+	podWatchGapSince  time.Time
+	podWatchGapsMutex sync.Mutex
+	// pods whose mounts were recorded, to skip their other events
+	podMountsRecorded = map[string]time.Time{}
+)
+
+// Whether a pod mounted the volume: one of its containers started, or a node attached it
+func volumeIsMounted(persV v1.PersistentVolume) bool {
+	for _, attachment := range attachmentsOf(persV) {
+		if attachment.Status.Attached {
+			return true
+		}
+	}
+	for _, pod := range podsReferencing(persV) {
+		if podContainerStarted(pod) {
+			return true
+		}
+	}
+	return false
+}
+
+// Records the mounts of all Bound PVs, and until when they were observed
+func trackVolumeMounts() error {
+	if !*trackMounts {
+		return nil
+	}
+	if err := recordMountObservation(time.Now()); err != nil {
+		return err
+	}
+	pvList, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	resetVolumeUsage()
+	if err := listVolumeUsage(); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, persV := range pvList.Items {
+		if persV.Status.Phase != v1.VolumeBound || persV.Spec.ClaimRef == nil {
+			continue
+		}
+		// mounted by an admin, not by its users
+		if _, ok := getTemporaryBinding(persV); ok {
+			continue
+		}
+		trackVolumeMount(persV, now)
+	}
+	return nil
+}
+
+func trackVolumeMount(persV v1.PersistentVolume, now time.Time) {
+	annotations := map[string]string{}
+	if _, ok := persV.ObjectMeta.Annotations[annotationMountTrackingSince]; !ok {
+		annotations[annotationMountTrackingSince] = now.Format(time.RFC3339)
+	}
+	if volumeIsMounted(persV) {
+		for key, value := range mountAnnotations(persV, now) {
+			annotations[key] = value
+		}
+	}
+	if len(annotations) == 0 {
+		return
+	}
+	klog.V(2).Infof("recording the mounts of PV %s: %v", persV.Name, annotations)
+	if err := setPVAnnotations(persV.Name, annotations); err != nil {
+		klog.Errorf("ERROR: recording the mounts of PV %s - %v", persV.Name, err)
+	}
+}
+
+// The annotations to update on a PV that is mounted now
+func mountAnnotations(persV v1.PersistentVolume, now time.Time) map[string]string {
+	annotations := map[string]string{}
+	if _, ok := persV.ObjectMeta.Annotations[annotationFirstMounted]; !ok {
+		annotations[annotationFirstMounted] = now.Format(time.RFC3339)
+	}
+	// not updated at every resync, to limit the number of PV updates
+	lastMounted, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationLastMounted])
+	if err != nil || now.Sub(lastMounted) >= *lastMountedResolution {
+		annotations[annotationLastMounted] = now.Format(time.RFC3339)
+	}
+	return annotations
+}
+
+// Watches pods and records the mounts of the PVs of their PVCs as soon as one of their containers starts
+func watchPodMounts() {
+	resourceVersion := ""
+	lastEvent := time.Now()
+	for {
+		watcher, err := kubeclient.kubeclient.CoreV1().Pods("").Watch(meta_v1.ListOptions{ResourceVersion: resourceVersion})
+		if err != nil {
+			klog.Errorf("ERROR: watching pods, the mounts since %s may be missed - %v", lastEvent.Format(time.RFC3339), err)
+			startPodWatchGap(lastEvent)
+			time.Sleep(*resyncPeriod)
+			continue
+		}
+		// the mounts are observed again from now on
+		endPodWatchGap(time.Now())
+		for event := range watcher.ResultChan() {
+			if event.Type == watch.Error {
+				// e.g. the resource version is too old: the events since the last one were missed, until the next watch starts
+				klog.Warningf("WARNING: pod watch interrupted, the mounts since %s may have been missed - %v", lastEvent.Format(time.RFC3339), event.Object)
+				startPodWatchGap(lastEvent)
+				resourceVersion = ""
+				break
+			}
+			pod, ok := event.Object.(*v1.Pod)
+			if !ok {
+				continue
+			}
+			resourceVersion = pod.ResourceVersion
+			lastEvent = time.Now()
+			if event.Type != watch.Deleted && podContainerStarted(*pod) {
+				recordPodMounts(*pod)
+			}
+		}
+		// the API server closes watches after a while, resume from the last event
+		watcher.Stop()
+	}
+}
+
+// Whether one of the containers of a pod, init containers included, started: the volumes are mounted before. Terminated
+// pods count too, so that short-lived Jobs finished between two resyncs are not missed.
+func podContainerStarted(pod v1.Pod) bool {
+	for _, statuses := range [][]v1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if status.State.Running != nil || status.State.Terminated != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The pod watch stopped, the mounts since the given time may have been missed
+func startPodWatchGap(since time.Time) {
+	podWatchGapsMutex.Lock()
+	defer podWatchGapsMutex.Unlock()
+	if podWatchGapSince.IsZero() {
+		podWatchGapSince = since
+	}
+}
+
+// The pod watch started again
+func endPodWatchGap(now time.Time) {
+	podWatchGapsMutex.Lock()
+	defer podWatchGapsMutex.Unlock()
+	if !podWatchGapSince.IsZero() {
+		podWatchGaps = append(podWatchGaps, observationPeriod{From: podWatchGapSince, To: now})
+		podWatchGapSince = time.Time{}
+	}
+}
+
+// The gaps of the pod watch not recorded yet, including the current one until now
+func pendingPodWatchGaps(now time.Time) []observationPeriod {
+	podWatchGapsMutex.Lock()
+	defer podWatchGapsMutex.Unlock()
+	gaps := append([]observationPeriod{}, podWatchGaps...)
+	if !podWatchGapSince.IsZero() {
+		gaps = append(gaps, observationPeriod{From: podWatchGapSince, To: now})
+	}
+	return gaps
+}
+
+// Records the mount of the PVs of the PVCs of a pod, once per pod and lastMountedResolution
+func recordPodMounts(pod v1.Pod) {
+	now := time.Now()
+	if recorded, ok := podMountsRecorded[string(pod.UID)]; ok && now.Sub(recorded) < *lastMountedResolution {
+		return
+	}
+	podMountsRecorded[string(pod.UID)] = now
+	for uid, recorded := range podMountsRecorded {
+		if now.Sub(recorded) >= *lastMountedResolution {
+			delete(podMountsRecorded, uid)
+		}
+	}
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		claim, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(volume.PersistentVolumeClaim.ClaimName, meta_v1.GetOptions{})
+		if err != nil || claim.Spec.VolumeName == "" {
+			continue
+		}
+		persV, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Get(claim.Spec.VolumeName, meta_v1.GetOptions{})
+		if err != nil || persV.Spec.ClaimRef == nil || persV.Spec.ClaimRef.UID != claim.UID {
+			continue
+		}
+		// mounted by an admin, not by its users
+		if _, ok := getTemporaryBinding(*persV); ok {
+			continue
+		}
+		if annotations := mountAnnotations(*persV, now); len(annotations) > 0 {
+			klog.V(2).Infof("recording the mount of PV %s by pod %s/%s: %v", persV.Name, pod.Namespace, pod.Name, annotations)
+			if err := setPVAnnotations(persV.Name, annotations); err != nil {
+				klog.Errorf("ERROR: recording the mounts of PV %s - %v", persV.Name, err)
+			}
+		}
+	}
+}
+
+// The mount observation recorded in mountTrackingConfigMap with the gaps of the pod watch not recorded yet, nil if
+// there is none or it cannot be read
+func getMountObservation() *mountObservation {
+	observation := getRecordedMountObservation()
+	if observation == nil {
+		return nil
+	}
+	withPending := *observation
+	withPending.Gaps = append(append([]observationPeriod{}, observation.Gaps...), pendingPodWatchGaps(time.Now())...)
+	return &withPending
+}
+
+// The mount observation recorded in mountTrackingConfigMap, nil if there is none or it cannot be read
+func getRecordedMountObservation() *mountObservation {
+	if !mountObservationLoaded {
+		mountObservationLoaded = true
+		configMap, err := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Get(*mountTrackingConfigMap, meta_v1.GetOptions{})
+		if err != nil {
+			if !api_errors.IsNotFound(err) {
+				klog.Errorf("ERROR: reading ConfigMap %s - %v", *mountTrackingConfigMap, err)
+			}
+			return nil
+		}
+		observation := &mountObservation{}
+		if err := json.Unmarshal([]byte(configMap.Data["observation"]), observation); err != nil {
+			klog.Errorf("ERROR: invalid mount observation in ConfigMap %s - %v", *mountTrackingConfigMap, err)
+			return nil
+		}
+		currentMountObservation = observation
+	}
+	return currentMountObservation
+}
+
+// Records that the mounts are observed at this time, and the gaps since the previous observation
+func recordMountObservation(now time.Time) error {
+	configMapsClient := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace())
+	configMap, err := configMapsClient.Get(*mountTrackingConfigMap, meta_v1.GetOptions{})
+	if err != nil && !api_errors.IsNotFound(err) {
+		return err
+	}
+	exists := err == nil
+	observation := mountObservation{GapsKnownSince: now}
+	if exists {
+		if err := json.Unmarshal([]byte(configMap.Data["observation"]), &observation); err != nil {
+			klog.Errorf("ERROR: invalid mount observation in ConfigMap %s, starting a new one - %v", *mountTrackingConfigMap, err)
+			observation = mountObservation{GapsKnownSince: now}
+		}
+	}
+
+	if !observation.LastObserved.IsZero() && now.Sub(observation.LastObserved) > mountObservationTolerance() {
+		// the controller was not running, or stuck
+		observation.Gaps = append(observation.Gaps, observationPeriod{From: observation.LastObserved, To: now})
+	}
+	podWatchGapsMutex.Lock()
+	observation.Gaps = append(observation.Gaps, podWatchGaps...)
+	podWatchGaps = nil
+	// the current gap is recorded when it ends, until then it is only known to this process
+	podWatchGapsMutex.Unlock()
+	if len(observation.Gaps) > maxMountObservationGaps {
+		observation.GapsKnownSince = observation.Gaps[len(observation.Gaps)-maxMountObservationGaps-1].To
+		observation.Gaps = observation.Gaps[len(observation.Gaps)-maxMountObservationGaps:]
+	}
+	observation.LastObserved = now
+
+	value, err := json.Marshal(observation)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		configMap = &v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: *mountTrackingConfigMap, Labels: map[string]string{managedByLabel: managedByValue}}}
+		configMap.Data = map[string]string{"observation": string(value)}
+		_, err = configMapsClient.Create(configMap)
+	} else {
+		configMap.Data = map[string]string{"observation": string(value)}
+		_, err = configMapsClient.Update(configMap)
+	}
+	if err != nil {
+		return err
+	}
+	currentMountObservation = &observation
+	mountObservationLoaded = true
+	return nil
+}
+
+// Longest time between two observations that is not a gap
+func mountObservationTolerance() time.Duration {
+	return 2*(*resyncPeriod) + time.Minute
+}
+
+// Whether the mounts of a PV were observed since its creation until its release without gap, and it was never mounted
+func pvWasNeverMounted(persV v1.PersistentVolume) bool {
+	if _, ok := persV.ObjectMeta.Annotations[annotationFirstMounted]; ok {
+		return false
+	}
+	trackingSince, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationMountTrackingSince])
+	if err != nil {
+		return false
+	}
+	// observed from one of the first resyncs after its creation on
+	if trackingSince.Sub(persV.CreationTimestamp.Time) > mountObservationTolerance() {
+		return false
+	}
+	observation := getMountObservation()
+	if observation == nil {
+		// unknown
+		return false
+	}
+	releasedAt, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationReleasedAt])
+	if err != nil {
+		releasedAt = time.Now()
+	}
+	return observedWithoutGap(*observation, persV.CreationTimestamp.Time, releasedAt)
+}
+
+// Whether the mounts were observed during the whole period, its ends included: a PV released during a gap may have
+// been mounted just before
+func observedWithoutGap(observation mountObservation, from, to time.Time) bool {
+	if from.Before(observation.GapsKnownSince) || observation.LastObserved.Before(to.Add(-mountObservationTolerance())) {
+		return false
+	}
+	for _, gap := range observation.Gaps {
+		if !gap.To.Before(from) && !gap.From.After(to) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a Released PV can be deleted without grace period because it was never mounted
+func pvCanBeReclaimedNeverMounted(persV v1.PersistentVolume) bool {
+	if !*reclaimNeverMounted || getPVReclaimingGracePeriod(persV) == 0 {
+		// be conservative: only reclaim volumes that have a valid annotationPeriodReclaimVolumesAfterRelease
+		return false
+	}
+	if _, ok := persV.ObjectMeta.Annotations[annotationRetentionExtendedBy]; ok {
+		// a user explicitly asked to keep this volume longer
+		return false
+	}
+	return pvWasNeverMounted(persV)
+}
+
+// The grace period of a PV that was not mounted during unusedThreshold before its release, or 0
+func unusedVolumeGracePeriod(persV v1.PersistentVolume) time.Duration {
+	if *unusedGracePeriod <= 0 {
+		return 0
+	}
+	// not pvReleasedAt, which depends on the grace period: the PVs released before annotationReleasedAt existed
+	// keep the grace period they were given
+	releasedAt, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationReleasedAt])
+	if err != nil {
+		if _, ok := persV.ObjectMeta.Annotations[annotationDelete]; ok {
+			return 0
+		}
+		// being released now
+		releasedAt = time.Now()
+	}
+	lastUsed, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationLastMounted])
+	if err != nil {
+		if !pvWasNeverMounted(persV) {
+			// unknown
+			return 0
+		}
+		lastUsed = persV.CreationTimestamp.Time
+	}
+	if releasedAt.Sub(lastUsed) < *unusedThreshold {
+		return 0
+	}
+	// a later mount may have been missed
+	if observation := getMountObservation(); observation == nil || !observedWithoutGap(*observation, lastUsed, releasedAt) {
+		return 0
+	}
+	return *unusedGracePeriod
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPVWasNeverMounted(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	created := now.Add(-48 * time.Hour)
+	released := now.Add(-time.Hour)
+	newPV := func(annotations map[string]string) v1.PersistentVolume {
+		annotations[annotationMountTrackingSince] = created.Add(time.Minute).Format(time.RFC3339)
+		annotations[annotationReleasedAt] = released.Format(time.RFC3339)
+		return v1.PersistentVolume{ObjectMeta: meta_v1.ObjectMeta{Name: "pv-test", CreationTimestamp: meta_v1.NewTime(created), Annotations: annotations}}
+	}
+	observed := mountObservation{LastObserved: now, GapsKnownSince: now.Add(-30 * 24 * time.Hour)}
+
+	cases := []struct {
+		name        string
+		persV       v1.PersistentVolume
+		observation *mountObservation
+		expected    bool
+	}{
+		{"observed without gap", newPV(map[string]string{}), &observed, true},
+		{"mounted", newPV(map[string]string{annotationFirstMounted: created.Add(time.Hour).Format(time.RFC3339)}), &observed, false},
+		{"no observation", newPV(map[string]string{}), nil, false},
+		{"controller down while the PV existed", newPV(map[string]string{}), &mountObservation{
+			LastObserved:   now,
+			GapsKnownSince: observed.GapsKnownSince,
+			Gaps:           []observationPeriod{{From: created.Add(2 * time.Hour), To: created.Add(3 * time.Hour)}},
+		}, false},
+		{"gap before the PV was created", newPV(map[string]string{}), &mountObservation{
+			LastObserved:   now,
+			GapsKnownSince: observed.GapsKnownSince,
+			Gaps:           []observationPeriod{{From: created.Add(-3 * time.Hour), To: created.Add(-2 * time.Hour)}},
+		}, true},
+		{"not observed until the release", newPV(map[string]string{}), &mountObservation{
+			LastObserved:   released.Add(-24 * time.Hour),
+			GapsKnownSince: observed.GapsKnownSince,
+		}, false},
+		{"gaps forgotten", newPV(map[string]string{}), &mountObservation{
+			LastObserved:   now,
+			GapsKnownSince: created.Add(time.Hour),
+		}, false},
+	}
+	defer func() {
+		currentMountObservation = nil
+		mountObservationLoaded = false
+		podWatchGaps = nil
+		podWatchGapSince = time.Time{}
+	}()
+	for _, c := range cases {
+		currentMountObservation = c.observation
+		mountObservationLoaded = true
+		if neverMounted := pvWasNeverMounted(c.persV); neverMounted != c.expected {
+			t.Errorf("%s: never mounted is %v, expected %v", c.name, neverMounted, c.expected)
+		}
+	}
+
+	// pod watch gaps not recorded in the ConfigMap yet
+	currentMountObservation = &observed
+	startPodWatchGap(released.Add(-time.Minute))
+	if pvWasNeverMounted(newPV(map[string]string{})) {
+		t.Errorf("released while the pod watch is interrupted: never mounted")
+	}
+	endPodWatchGap(released)
+	if pvWasNeverMounted(newPV(map[string]string{})) {
+		t.Errorf("released at the end of a pod watch gap: never mounted")
+	}
+}
+
+func TestPodContainerStarted(t *testing.T) {
+	started := v1.ContainerStatus{State: v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}}}
+	waiting := v1.ContainerStatus{State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}}
+	cases := []struct {
+		name     string
+		status   v1.PodStatus
+		expected bool
+	}{
+		{"pending", v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{waiting}}, false},
+		{"container started", v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{started}}, true},
+		{"init container started", v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{started}, ContainerStatuses: []v1.ContainerStatus{waiting}}, true},
+	}
+	for _, c := range cases {
+		if podContainerStarted(v1.Pod{Status: c.status}) != c.expected {
+			t.Errorf("%s: started is %v", c.name, !c.expected)
+		}
+	}
+}
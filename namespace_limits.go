@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog"
+)
+
+// Projects that churn through PVCs can leave a lot of retained volumes behind within their grace period. When the
+// retained volumes of a namespace (of their former PVC) exceed a limit, the grace period of its oldest ones is
+// shortened, never to less than -namespaceLimitMinimumRetention after their release, and their owners are notified.
+
+var (
+	namespaceRetainedCapacityLimit = flag.String("namespaceRetainedCapacityLimit", "", "maximum total capacity (e.g. 2Ti) of the retained volumes of a namespace before the grace period of its oldest ones is shortened. No limit if empty")
+	namespaceRetainedCountLimit    = flag.Int("namespaceRetainedCountLimit", 0, "maximum number of retained volumes of a namespace before the grace period of its oldest ones is shortened. No limit if 0")
+	namespaceLimitMinimumRetention = flag.Duration("namespaceLimitMinimumRetention", 24*time.Hour, "the grace period of volumes shortened because their namespace exceeds its limit never ends less than this after their release")
+)
+
+// Retained volumes of a namespace compared with the limits
+type namespaceUsage struct {
+	Namespace          string `json:"namespace"`
+	Count              int    `json:"count"`
+	CapacityBytes      int64  `json:"capacityBytes"`
+	CountLimit         int    `json:"countLimit,omitempty"`
+	CapacityLimitBytes int64  `json:"capacityLimitBytes,omitempty"`
+	OverLimit          bool   `json:"overLimit"`
+}
+
+func namespaceCapacityLimit() (int64, error) {
+	if *namespaceRetainedCapacityLimit == "" {
+		return 0, nil
+	}
+	limit, err := resource.ParseQuantity(*namespaceRetainedCapacityLimit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -namespaceRetainedCapacityLimit '%s' - %v", *namespaceRetainedCapacityLimit, err)
+	}
+	return limit.Value(), nil
+}
+
+func (usage namespaceUsage) exceeds(count int, capacityBytes int64) bool {
+	return (usage.CountLimit > 0 && count > usage.CountLimit) || (usage.CapacityLimitBytes > 0 && capacityBytes > usage.CapacityLimitBytes)
+}
+
+// Whether a PV counts as retained: Released, and to be reclaimed after its grace period
+func pvIsRetained(persV v1.PersistentVolume) bool {
+	return persV.Status.Phase == v1.VolumeReleased && persV.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete &&
+		persV.Spec.ClaimRef != nil && getPVReclaimingGracePeriod(persV) > 0
+}
+
+// The retained volumes of each namespace, oldest released first, and their usage. Returns nil if no limit is configured.
+func namespaceRetainedUsage(pvs []v1.PersistentVolume, now time.Time) (map[string]*namespaceUsage, map[string][]int, error) {
+	capacityLimit, err := namespaceCapacityLimit()
+	if err != nil {
+		return nil, nil, err
+	}
+	if capacityLimit == 0 && *namespaceRetainedCountLimit <= 0 {
+		return nil, nil, nil
+	}
+	usages := map[string]*namespaceUsage{}
+	volumes := map[string][]int{}
+	for i, persV := range pvs {
+		if !pvIsRetained(persV) {
+			continue
+		}
+		namespace := persV.Spec.ClaimRef.Namespace
+		if usages[namespace] == nil {
+			usages[namespace] = &namespaceUsage{Namespace: namespace, CountLimit: *namespaceRetainedCountLimit, CapacityLimitBytes: capacityLimit}
+		}
+		usages[namespace].Count++
+		usages[namespace].CapacityBytes += pvCapacityBytes(persV)
+		volumes[namespace] = append(volumes[namespace], i)
+	}
+	for namespace, usage := range usages {
+		usage.OverLimit = usage.exceeds(usage.Count, usage.CapacityBytes)
+		indexes := volumes[namespace]
+		sort.Slice(indexes, func(i, j int) bool {
+			return releasedAtOrNow(pvs[indexes[i]], now).Before(releasedAtOrNow(pvs[indexes[j]], now))
+		})
+	}
+	return usages, volumes, nil
+}
+
+// PVs that were just released do not have a release time yet
+func releasedAtOrNow(persV v1.PersistentVolume, now time.Time) time.Time {
+	if releasedAt, ok := pvReleasedAt(persV); ok {
+		return releasedAt
+	}
+	return now
+}
+
+// Shortens the grace period of the oldest retained volumes of the namespaces over their limit, so that the remaining
+// ones fit. The deletion timestamps are updated in pvs too, so the rest of the run sees them.
+func enforceNamespaceLimits(pvs []v1.PersistentVolume) {
+	now := time.Now()
+	usages, volumes, err := namespaceRetainedUsage(pvs, now)
+	if err != nil {
+		klog.Errorf("ERROR: namespace limits not enforced - %v", err)
+		return
+	}
+	overLimit := 0
+	for namespace, usage := range usages {
+		if !usage.OverLimit {
+			continue
+		}
+		overLimit++
+		count, capacityBytes := usage.Count, usage.CapacityBytes
+		for _, i := range volumes[namespace] {
+			if !usage.exceeds(count, capacityBytes) {
+				break
+			}
+			// the remaining volumes fit once this one is gone
+			count--
+			capacityBytes -= pvCapacityBytes(pvs[i])
+			shortenGracePeriodForNamespaceLimit(&pvs[i], *usage, now)
+		}
+	}
+	setGauge("reclaim_volumes_namespaces_over_limit", "Number of namespaces whose retained volumes exceed the namespace limit at the last run", float64(overLimit))
+}
+
+func shortenGracePeriodForNamespaceLimit(persV *v1.PersistentVolume, usage namespaceUsage, now time.Time) {
+	// a user explicitly asked to keep this volume longer
+	if _, ok := persV.ObjectMeta.Annotations[annotationRetentionExtendedBy]; ok {
+		return
+	}
+	releasedAt := releasedAtOrNow(*persV, now)
+	tDelete := releasedAt.Add(*namespaceLimitMinimumRetention)
+	if tDelete.Before(now) {
+		tDelete = now
+	}
+	if current, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationDelete]); err == nil && !tDelete.Before(current) {
+		// already due at least as early
+		return
+	}
+
+	reason := fmt.Sprintf("namespace %s retains %d volume(s) of %s in total", usage.Namespace, usage.Count, formatBytes(usage.CapacityBytes))
+	if usage.CountLimit > 0 {
+		reason += fmt.Sprintf(", limit %d volume(s)", usage.CountLimit)
+	}
+	if usage.CapacityLimitBytes > 0 {
+		reason += ", limit " + formatBytes(usage.CapacityLimitBytes)
+	}
+	klog.Infof("INFO: shortening the grace period of PV %s to %s: %s", persV.Name, tDelete.Format(time.RFC3339), reason)
+	if _, ok := persV.ObjectMeta.Annotations[annotationReleasedAt]; !ok {
+		// the release time can no longer be computed from the deletion timestamp once it is shortened
+		if err := setPVAnnotations(persV.Name, map[string]string{annotationReleasedAt: releasedAt.Format(time.RFC3339)}); err != nil {
+			return
+		}
+	}
+	if err := setPVDateAnnotation(*persV, annotationDelete, tDelete, reason); err != nil {
+		return
+	}
+	summary.ShortenedGracePeriods++
+	if persV.ObjectMeta.Annotations == nil {
+		persV.ObjectMeta.Annotations = map[string]string{}
+	}
+	persV.ObjectMeta.Annotations[annotationDelete] = tDelete.Format(time.RFC3339)
+	queueNotification(*persV, notificationShortened, tDelete.Format(time.RFC3339))
+}
+
+// The usage of all namespaces with retained volumes, sorted by namespace, for the report
+func namespaceUsageReport(pvs []v1.PersistentVolume, now time.Time) ([]namespaceUsage, error) {
+	usages, _, err := namespaceRetainedUsage(pvs, now)
+	if err != nil || usages == nil {
+		return nil, err
+	}
+	report := []namespaceUsage{}
+	for _, usage := range usages {
+		report = append(report, *usage)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Namespace < report[j].Namespace })
+	return report, nil
+}
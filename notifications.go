@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Records which notifications were already delivered for a PV, so they are not repeated every run.
+// JSON map of <sink>/<event> (or <event> alone, delivered by all sinks) to the deletion timestamp it was sent for: if the
+// deletion timestamp changes (e.g. retention extended), the notifications are sent again.
+const annotationNotificationsSent = "reclaim-volumes.cern.ch/notifications-sent"
+
+// Points of the reclaiming process where owners are notified
+const (
+	notificationScheduled = "scheduled"
+	notificationReminder  = "reminder"
+	notificationDeleted   = "deleted"
+	// the grace period was shortened because the namespace retains too many volumes
+	notificationShortened = "shortened"
+	// for admins: the deletion of a volume is due but needs their approval
+	notificationApprovalRequired = "approval-required"
+)
+
+var (
+	notifyWebhookURL      = flag.String("notifyWebhookURL", "", "send notifications about retained volumes to this HTTP webhook")
+	notifyWebhookFormat   = flag.String("notifyWebhookFormat", "generic", "payload of the webhook notifications: generic (JSON document) or slack (Mattermost/Slack-compatible incoming webhook)")
+	notifyReminderBefore  = flag.Duration("notifyReminderBefore", 72*time.Hour, "send a reminder this long before a retained volume is deleted")
+	notifyTemplatesDir    = flag.String("notifyTemplatesDir", "", "directory with <event>.tmpl files overriding the default notification messages (events: scheduled, reminder, deleted, shortened, approval-required)")
+	notifyOutboxConfigMap = flag.String("notifyOutboxConfigMap", "reclaim-volumes-notifications", "ConfigMap in the namespace of the reclaimer keeping the notifications not delivered yet, retried at the next runs")
+	notifyRetryFor        = flag.Duration("notifyRetryFor", 7*24*time.Hour, "notifications still not delivered after this long are dropped")
+)
+
+// Everything the message templates can use about a volume
+type notification struct {
+	Event             string        `json:"event"`
+	PersistentVolume  string        `json:"persistentVolume"`
+	ClaimName         string        `json:"claimName"`
+	Namespace         string        `json:"namespace"`
+	Capacity          string        `json:"capacity"`
+	StorageClass      string        `json:"storageClass"`
+	DeletionTimestamp string        `json:"deletionTimestamp"`
+	Metadata          claimMetadata `json:"metadata"`
+}
+
+// A notification waiting to be delivered
+type queuedNotification struct {
+	Notification notification `json:"notification"`
+	// the sinks it is still to be delivered to
+	Pending  []string  `json:"pending"`
+	QueuedAt time.Time `json:"queuedAt"`
+	// the sinks it was delivered to during this run
+	delivered []string
+}
+
+var defaultNotificationTemplates = map[string]string{
+	notificationScheduled:        `The volume of the deleted PVC {{.ClaimName}} in namespace {{.Namespace}} ({{.Capacity}}, PV {{.PersistentVolume}}) is retained and will be permanently deleted after {{.DeletionTimestamp}}.`,
+	notificationReminder:         `Reminder: the volume of the deleted PVC {{.ClaimName}} in namespace {{.Namespace}} ({{.Capacity}}, PV {{.PersistentVolume}}) will be permanently deleted after {{.DeletionTimestamp}}.`,
+	notificationDeleted:          `The volume of the deleted PVC {{.ClaimName}} in namespace {{.Namespace}} ({{.Capacity}}, PV {{.PersistentVolume}}) is now being permanently deleted.`,
+	notificationShortened:        `The namespace {{.Namespace}} retains more volumes of deleted PVCs than allowed: the volume of the deleted PVC {{.ClaimName}} ({{.Capacity}}, PV {{.PersistentVolume}}) will now be permanently deleted after {{.DeletionTimestamp}}.`,
+	notificationApprovalRequired: `The volume of the deleted PVC {{.ClaimName}} in namespace {{.Namespace}} ({{.Capacity}}, PV {{.PersistentVolume}}) was due for deletion on {{.DeletionTimestamp}} and is awaiting approval: approve {{.PersistentVolume}}`,
+}
+
+// A way of delivering notifications. Sinks get all the notifications of a run at once so they can group them.
+type notificationSink interface {
+	name() string
+	// returns whether each notification was delivered. Failures are logged, the undelivered notifications are retried.
+	send(notifications []notification) []bool
+}
+
+var (
+	notificationSinks            []notificationSink
+	notificationSinksInitialized bool
+	pendingNotifications         []queuedNotification
+)
+
+// Creates the sinks configured on the command line
+func getNotificationSinks() []notificationSink {
+	if !notificationSinksInitialized {
+		notificationSinksInitialized = true
+		if *notifyWebhookURL != "" {
+			notificationSinks = append(notificationSinks, &webhookSink{url: *notifyWebhookURL, format: *notifyWebhookFormat, client: &http.Client{Timeout: 30 * time.Second}})
+		}
+		if *smtpServer != "" {
+			notificationSinks = append(notificationSinks, newEmailSink())
+		}
+	}
+	return notificationSinks
+}
+
+// Queues a notification about a PV, to be sent at the end of the run by the sinks that did not deliver it yet for this
+// deletion timestamp
+func queueNotification(persV v1.PersistentVolume, event, deletionTimestamp string) {
+	sent := map[string]string{}
+	if value, ok := persV.ObjectMeta.Annotations[annotationNotificationsSent]; ok {
+		json.Unmarshal([]byte(value), &sent)
+	}
+	pending := []string{}
+	for _, sink := range getNotificationSinks() {
+		if !notificationWasSent(sent, sink.name(), event, deletionTimestamp) {
+			pending = append(pending, sink.name())
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	n := notification{
+		Event:             event,
+		PersistentVolume:  persV.Name,
+		StorageClass:      persV.Spec.StorageClassName,
+		DeletionTimestamp: deletionTimestamp,
+		Metadata:          getClaimMetadata(persV),
+	}
+	if claimRef := userClaimRef(persV); claimRef != nil {
+		n.ClaimName = claimRef.Name
+		n.Namespace = claimRef.Namespace
+	}
+	if capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]; ok {
+		n.Capacity = capacity.String()
+	}
+	pendingNotifications = append(pendingNotifications, queuedNotification{Notification: n, Pending: pending, QueuedAt: time.Now()})
+}
+
+func notificationWasSent(sent map[string]string, sinkName, event, deletionTimestamp string) bool {
+	for _, key := range []string{sinkName + "/" + event, event} {
+		if value, ok := sent[key]; ok && value == deletionTimestamp {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends a reminder for PVs whose deletion is less than notifyReminderBefore away
+func queueReminderIfDue(persV v1.PersistentVolume) {
+	deletionTimestamp := persV.ObjectMeta.Annotations[annotationDelete]
+	tDelete, err := time.Parse(time.RFC3339, deletionTimestamp)
+	if err != nil {
+		return
+	}
+	if time.Now().Add(*notifyReminderBefore).After(tDelete) {
+		queueNotification(persV, notificationReminder, deletionTimestamp)
+	}
+}
+
+// Delivers the notifications queued during the run, and the ones not delivered by earlier runs, through all sinks.
+// What each sink delivered is recorded on the PVs; the rest is kept in notifyOutboxConfigMap and attempted again at the
+// next run, also for PVs that are gone by then.
+func flushNotifications() {
+	queued := pendingNotifications
+	pendingNotifications = nil
+	if len(getNotificationSinks()) == 0 {
+		return
+	}
+	configMap, outbox, err := loadNotificationOutbox()
+	if err != nil {
+		klog.Errorf("ERROR: reading the notifications to retry from ConfigMap %s - %v", *notifyOutboxConfigMap, err)
+	}
+	queued = mergeQueuedNotifications(outbox, queued)
+	if len(queued) == 0 {
+		return
+	}
+
+	for _, sink := range getNotificationSinks() {
+		indexes := []int{}
+		notifications := []notification{}
+		for i, q := range queued {
+			if stringInList(sink.name(), q.Pending) {
+				indexes = append(indexes, i)
+				notifications = append(notifications, q.Notification)
+			}
+		}
+		if len(notifications) == 0 {
+			continue
+		}
+		for j, delivered := range sink.send(notifications) {
+			if !delivered {
+				continue
+			}
+			q := &queued[indexes[j]]
+			q.delivered = append(q.delivered, sink.name())
+			pending := []string{}
+			for _, name := range q.Pending {
+				if name != sink.name() {
+					pending = append(pending, name)
+				}
+			}
+			q.Pending = pending
+		}
+	}
+	recordNotificationDeliveries(queued)
+
+	undelivered := []queuedNotification{}
+	deliveries := 0
+	for _, q := range queued {
+		deliveries += len(q.delivered)
+		if len(q.Pending) == 0 {
+			continue
+		}
+		if time.Since(q.QueuedAt) > *notifyRetryFor {
+			klog.Errorf("ERROR: giving up the %s notification of PV %s, not delivered by %v since %s", q.Notification.Event,
+				q.Notification.PersistentVolume, q.Pending, q.QueuedAt.Format(time.RFC3339))
+			continue
+		}
+		undelivered = append(undelivered, q)
+	}
+	if err == nil {
+		// not overwritten if it could not be read
+		if err := saveNotificationOutbox(configMap, undelivered); err != nil {
+			klog.Errorf("ERROR: saving the notifications to retry in ConfigMap %s - %v", *notifyOutboxConfigMap, err)
+		}
+	}
+	klog.Infof("INFO: %d notification(s) delivered, %d to retry", deliveries, len(undelivered))
+}
+
+// The notifications of earlier runs followed by the new ones, without duplicates (e.g. a reminder queued again)
+func mergeQueuedNotifications(outbox, queued []queuedNotification) []queuedNotification {
+	merged := []queuedNotification{}
+	index := map[string]int{}
+	for _, q := range append(outbox, queued...) {
+		key := q.Notification.PersistentVolume + "/" + q.Notification.Event + "/" + q.Notification.DeletionTimestamp
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, q)
+			continue
+		}
+		for _, name := range q.Pending {
+			if !stringInList(name, merged[i].Pending) {
+				merged[i].Pending = append(merged[i].Pending, name)
+			}
+		}
+	}
+	return merged
+}
+
+// Adds what each sink delivered to the annotationNotificationsSent of the PVs
+func recordNotificationDeliveries(queued []queuedNotification) {
+	deliveredByPV := map[string]map[string]string{}
+	for _, q := range queued {
+		for _, name := range q.delivered {
+			if deliveredByPV[q.Notification.PersistentVolume] == nil {
+				deliveredByPV[q.Notification.PersistentVolume] = map[string]string{}
+			}
+			deliveredByPV[q.Notification.PersistentVolume][name+"/"+q.Notification.Event] = q.Notification.DeletionTimestamp
+		}
+	}
+	for pvName, delivered := range deliveredByPV {
+		persV, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Get(pvName, meta_v1.GetOptions{})
+		if err != nil {
+			// a PV being deleted may already be gone, nothing to record then
+			if !api_errors.IsNotFound(err) {
+				klog.Errorf("ERROR: getting PV %s to record its notifications - %v", pvName, err)
+			}
+			continue
+		}
+		sent := map[string]string{}
+		if value, ok := persV.ObjectMeta.Annotations[annotationNotificationsSent]; ok {
+			json.Unmarshal([]byte(value), &sent)
+		}
+		for key, deletionTimestamp := range delivered {
+			sent[key] = deletionTimestamp
+		}
+		value, err := json.Marshal(sent)
+		if err != nil {
+			continue
+		}
+		setPVAnnotations(pvName, map[string]string{annotationNotificationsSent: string(value)})
+	}
+}
+
+func loadNotificationOutbox() (*v1.ConfigMap, []queuedNotification, error) {
+	outbox := []queuedNotification{}
+	configMap, err := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Get(*notifyOutboxConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		return nil, outbox, nil
+	}
+	if err != nil {
+		return nil, outbox, err
+	}
+	if value := configMap.Data["notifications"]; value != "" {
+		if err := json.Unmarshal([]byte(value), &outbox); err != nil {
+			return nil, []queuedNotification{}, err
+		}
+	}
+	return configMap, outbox, nil
+}
+
+func saveNotificationOutbox(configMap *v1.ConfigMap, outbox []queuedNotification) error {
+	if configMap == nil && len(outbox) == 0 {
+		return nil
+	}
+	value, err := json.Marshal(outbox)
+	if err != nil {
+		return err
+	}
+	if configMap == nil {
+		configMap = &v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: *notifyOutboxConfigMap, Labels: map[string]string{managedByLabel: managedByValue}}}
+		configMap.Data = map[string]string{"notifications": string(value)}
+		_, err = kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Create(configMap)
+		return err
+	}
+	configMap.Data = map[string]string{"notifications": string(value)}
+	_, err = kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Update(configMap)
+	return err
+}
+
+// Renders the message of a notification, from the templates directory if one is configured
+func renderNotification(n notification) (string, error) {
+	text := defaultNotificationTemplates[n.Event]
+	if *notifyTemplatesDir != "" {
+		content, err := ioutil.ReadFile(filepath.Join(*notifyTemplatesDir, n.Event+".tmpl"))
+		if err == nil {
+			text = string(content)
+		}
+	}
+	tmpl, err := template.New(n.Event).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, n); err != nil {
+		return "", err
+	}
+	return message.String(), nil
+}
+
+// Posts each notification to an HTTP endpoint
+type webhookSink struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+func (sink *webhookSink) name() string {
+	return "webhook"
+}
+
+func (sink *webhookSink) send(notifications []notification) []bool {
+	delivered := make([]bool, len(notifications))
+	for i, n := range notifications {
+		if err := sink.post(n); err != nil {
+			// most likely unreachable: the rest is retried at the next run
+			klog.Errorf("ERROR: sending notifications to the webhook - %v", err)
+			break
+		}
+		delivered[i] = true
+	}
+	return delivered
+}
+
+func (sink *webhookSink) post(n notification) error {
+	message, err := renderNotification(n)
+	if err != nil {
+		return err
+	}
+
+	var payload interface{}
+	switch sink.format {
+	case "slack":
+		payload = map[string]string{"text": message}
+	default:
+		payload = struct {
+			notification
+			Message string `json:"message"`
+		}{n, message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sink.client.Post(sink.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s for the %s notification of PV %s", resp.Status, n.Event, n.PersistentVolume)
+	}
+	return nil
+}
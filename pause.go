@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Kill switch: during an incident, admins stop all deletions by creating a ConfigMap in the namespace of the reclaimer,
+// without redeploying it or suspending the CronJob:
+//
+//   oc create configmap reclaim-volumes-pause --from-literal=paused=true --from-literal=reason=INC123 --from-literal=expires=2026-11-01T00:00:00Z
+//
+// While paused, PVs keep being reported and annotated, but none is set to Delete.
+
+var pauseConfigMap = flag.String("pauseConfigMap", "reclaim-volumes-pause", "ConfigMap, in the namespace of the reclaimer, that pauses all deletions when its 'paused' key is true (optional keys: 'reason' and 'expires', an RFC3339 time). Not used if empty")
+
+// Why reclaiming is paused, or an empty string if it is not. Read from the API every time, so a pause applies immediately.
+func reclaimPausedReason() string {
+	if *pauseConfigMap == "" {
+		return ""
+	}
+	configMap, err := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Get(*pauseConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		return ""
+	}
+	if err != nil {
+		// be conservative: if we cannot tell whether an admin paused us, do not delete
+		return fmt.Sprintf("cannot read ConfigMap %s - %v", *pauseConfigMap, err)
+	}
+	return pausedReason(configMap, time.Now())
+}
+
+func pausedReason(configMap *v1.ConfigMap, now time.Time) string {
+	if paused, _ := strconv.ParseBool(configMap.Data["paused"]); !paused {
+		return ""
+	}
+	reason := "paused by ConfigMap " + configMap.Name
+	if configMap.Data["reason"] != "" {
+		reason += ": " + configMap.Data["reason"]
+	}
+	if expires := configMap.Data["expires"]; expires != "" {
+		tExpires, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			// an invalid expiry must not end the pause
+			return reason + " (invalid expiry '" + expires + "' ignored)"
+		}
+		if now.After(tExpires) {
+			return ""
+		}
+		reason += " (until " + expires + ")"
+	}
+	return reason
+}
+
+// Logs and exposes whether reclaiming is paused. Called at startup and at the end of every run.
+func publishPausedState() {
+	reason := reclaimPausedReason()
+	paused := 0.0
+	if reason != "" {
+		paused = 1
+		klog.Warningf("WARNING: reclaiming is paused, no PV will be deleted: %s", reason)
+	}
+	setGauge("reclaim_volumes_paused", "Whether all deletions are paused by the kill switch ConfigMap", paused)
+}
+
+// Deletion guard: blocks all deletions while reclaiming is paused
+func pauseGuard(persV v1.PersistentVolume, trigger string) string {
+	return reclaimPausedReason()
+}
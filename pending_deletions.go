@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"reflect"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// ConfigMap published in the namespace of the deleted PVCs, listing their retained volumes
+	pendingDeletionsConfigMapName = "reclaim-volumes-pending-deletions"
+	managedByLabel                = "app.kubernetes.io/managed-by"
+	managedByValue                = "reclaim-cephfs-volumes"
+)
+
+var publishPendingDeletions = flag.Bool("publishPendingDeletions", true, "publish the list of retained volumes and their deletion date in a ConfigMap in the namespace of the deleted PVCs")
+
+// What users see about one of their retained volumes (one entry per PV in the ConfigMap)
+type pendingDeletion struct {
+	PersistentVolume  string `json:"persistentVolume"`
+	ClaimName         string `json:"claimName"`
+	Capacity          string `json:"capacity"`
+	StorageClass      string `json:"storageClass"`
+	DeletionTimestamp string `json:"deletionTimestamp,omitempty"`
+	// Retained (until DeletionTimestamp) or Deleting
+	State string `json:"state"`
+}
+
+// Users cannot see PVs, which are cluster-scoped. Publish in each namespace the Released PVs whose claim was in it,
+// so users know the data still exists and when it will be reclaimed. ConfigMaps of namespaces without any retained
+// volume left are removed.
+func publishPendingDeletionsConfigMaps() {
+	if !*publishPendingDeletions {
+		return
+	}
+
+	pvList, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+	if err != nil {
+		klog.Errorf("ERROR: listing PVs to publish pending deletions - %v", err)
+		return
+	}
+
+	desired := map[string]map[string]string{}
+	for _, persV := range pvList.Items {
+		entry, ok := pendingDeletionOf(persV)
+		if !ok {
+			continue
+		}
+		value, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		namespace := userClaimRef(persV).Namespace
+		if desired[namespace] == nil {
+			desired[namespace] = map[string]string{}
+		}
+		desired[namespace][persV.Name] = string(value)
+	}
+
+	existing, err := kubeclient.kubeclient.CoreV1().ConfigMaps("").List(meta_v1.ListOptions{LabelSelector: managedByLabel + "=" + managedByValue})
+	if err != nil {
+		klog.Errorf("ERROR: listing ConfigMaps of pending deletions - %v", err)
+		return
+	}
+	for _, configMap := range existing.Items {
+		if configMap.Name != pendingDeletionsConfigMapName {
+			continue
+		}
+		data, ok := desired[configMap.Namespace]
+		delete(desired, configMap.Namespace)
+		if !ok {
+			klog.V(2).Infof("removing ConfigMap of pending deletions in namespace %s", configMap.Namespace)
+			err := kubeclient.kubeclient.CoreV1().ConfigMaps(configMap.Namespace).Delete(configMap.Name, &meta_v1.DeleteOptions{})
+			if err != nil && !api_errors.IsNotFound(err) {
+				klog.Errorf("ERROR: deleting ConfigMap %s/%s - %v", configMap.Namespace, configMap.Name, err)
+			}
+			continue
+		}
+		if reflect.DeepEqual(configMap.Data, data) {
+			continue
+		}
+		configMap.Data = data
+		if _, err := kubeclient.kubeclient.CoreV1().ConfigMaps(configMap.Namespace).Update(&configMap); err != nil {
+			klog.Errorf("ERROR: updating ConfigMap %s/%s - %v", configMap.Namespace, configMap.Name, err)
+		}
+	}
+
+	// namespaces that did not have a ConfigMap yet
+	for namespace, data := range desired {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name:      pendingDeletionsConfigMapName,
+				Namespace: namespace,
+				Labels:    map[string]string{managedByLabel: managedByValue},
+				Annotations: map[string]string{
+					"description": "Volumes of deleted PVCs of this namespace that are still retained, and when they will be deleted. Managed by the reclaimer, do not edit.",
+				},
+			},
+			Data: data,
+		}
+		_, err := kubeclient.kubeclient.CoreV1().ConfigMaps(namespace).Create(configMap)
+		if api_errors.IsNotFound(err) {
+			// the namespace itself has been deleted, nobody to tell
+			continue
+		}
+		if err != nil {
+			klog.Errorf("ERROR: creating ConfigMap %s/%s - %v", namespace, pendingDeletionsConfigMapName, err)
+		}
+	}
+}
+
+// Returns what to publish about a PV, if it is a retained volume of a deleted PVC
+func pendingDeletionOf(persV v1.PersistentVolume) (pendingDeletion, bool) {
+	claimRef := userClaimRef(persV)
+	if !pvIsReleased(persV) || claimRef == nil {
+		return pendingDeletion{}, false
+	}
+	entry := pendingDeletion{
+		PersistentVolume:  persV.Name,
+		ClaimName:         claimRef.Name,
+		StorageClass:      persV.Spec.StorageClassName,
+		DeletionTimestamp: persV.ObjectMeta.Annotations[annotationDelete],
+		State:             "Retained",
+	}
+	if capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]; ok {
+		entry.Capacity = capacity.String()
+	}
+	if persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+		entry.State = "Deleting"
+	} else if entry.DeletionTimestamp == "" {
+		// not (yet) scheduled for deletion by the reclaimer
+		return pendingDeletion{}, false
+	}
+	return entry, true
+}
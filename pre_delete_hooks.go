@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	batch_v1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// The data of some StorageClasses or namespaces must be archived (tar to object storage, rsync to tape staging...)
+// before it is deleted. A pre-delete hook is a Job, run with the PV mounted through a temporary binding (see
+// temporary_binding.go), that must succeed before the reclaim policy of the PV is set to Delete. The preDeleteHookGuard
+// starts it; processPreDeleteHooks records its result on the PV and puts the PV back in the Released phase.
+
+// State of the pre-delete hook of a PV, as JSON
+const annotationPreDeleteHook = "reclaim-volumes.cern.ch/pre-delete-hook"
+
+const auditPreDeleteHook = "pre-delete-hook"
+
+// Phases of a pre-delete hook
+const (
+	hookPhaseRunning   = "Running"
+	hookPhaseSucceeded = "Succeeded"
+	hookPhaseFailed    = "Failed"
+)
+
+var (
+	preDeleteHooksFile      = flag.String("preDeleteHooksFile", "", "YAML file with the pre-delete hooks, Jobs that must succeed before the PVs of some StorageClasses or namespaces are deleted. Read once at startup")
+	preDeleteHookTimeout    = flag.Duration("preDeleteHookTimeout", 6*time.Hour, "default timeout of a pre-delete hook attempt")
+	preDeleteHookAttempts   = flag.Int("preDeleteHookAttempts", 3, "default number of attempts of a pre-delete hook before the deletion is blocked until an admin intervenes")
+	preDeleteHookRetryDelay = flag.Duration("preDeleteHookRetryDelay", time.Hour, "delay between the attempts of a pre-delete hook")
+)
+
+// A pre-delete hook, as configured in preDeleteHooksFile
+type preDeleteHook struct {
+	Name string `json:"name"`
+	// the hook applies to the PVs of these StorageClasses and of the former PVCs in these namespaces. Empty means all.
+	StorageClasses []string `json:"storageClasses,omitempty"`
+	Namespaces     []string `json:"namespaces,omitempty"`
+	// namespace of the Jobs and of the PVCs temporarily binding the PVs. The namespace of the reclaimer if empty.
+	Namespace   string            `json:"namespace,omitempty"`
+	Timeout     *meta_v1.Duration `json:"timeout,omitempty"`
+	MaxAttempts int               `json:"maxAttempts,omitempty"`
+	// pod of the Job. The volume "data", the PV mounted read-only, is added to it, and the environment variables
+	// PV_NAME, PVC_NAMESPACE, PVC_NAME and STORAGE_CLASS to its containers.
+	Template v1.PodTemplateSpec `json:"template"`
+}
+
+// What happened to the pre-delete hook of a PV
+type preDeleteHookState struct {
+	Hook        string     `json:"hook"`
+	Phase       string     `json:"phase"`
+	Attempts    int        `json:"attempts"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Job         string     `json:"job,omitempty"`
+	StartedAt   time.Time  `json:"startedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Message     string     `json:"message,omitempty"`
+}
+
+// Read on first use
+var (
+	preDeleteHooks       []preDeleteHook
+	preDeleteHooksErr    error
+	preDeleteHooksLoaded bool
+)
+
+func loadPreDeleteHooks(path string) ([]preDeleteHook, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hooks := []preDeleteHook{}
+	if err := yaml.Unmarshal(content, &hooks); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, hook := range hooks {
+		if hook.Name == "" || names[hook.Name] {
+			return nil, fmt.Errorf("each hook needs a unique name")
+		}
+		names[hook.Name] = true
+		if len(hook.Template.Spec.Containers) == 0 {
+			return nil, fmt.Errorf("hook %s has no container", hook.Name)
+		}
+	}
+	return hooks, nil
+}
+
+func getPreDeleteHooks() ([]preDeleteHook, error) {
+	if !preDeleteHooksLoaded {
+		preDeleteHooksLoaded = true
+		if *preDeleteHooksFile != "" {
+			preDeleteHooks, preDeleteHooksErr = loadPreDeleteHooks(*preDeleteHooksFile)
+			if preDeleteHooksErr != nil {
+				klog.Errorf("ERROR: invalid -preDeleteHooksFile, deletions are blocked - %v", preDeleteHooksErr)
+			}
+		}
+	}
+	return preDeleteHooks, preDeleteHooksErr
+}
+
+func (hook preDeleteHook) applies(persV v1.PersistentVolume) bool {
+	if len(hook.StorageClasses) > 0 && !stringInList(persV.Spec.StorageClassName, hook.StorageClasses) {
+		return false
+	}
+	if claimRef := userClaimRef(persV); len(hook.Namespaces) > 0 && (claimRef == nil || !stringInList(claimRef.Namespace, hook.Namespaces)) {
+		return false
+	}
+	return true
+}
+
+func (hook preDeleteHook) namespace() string {
+	if hook.Namespace == "" {
+		return currentNamespace()
+	}
+	return hook.Namespace
+}
+
+func (hook preDeleteHook) timeout() time.Duration {
+	if hook.Timeout == nil || hook.Timeout.Duration <= 0 {
+		return *preDeleteHookTimeout
+	}
+	return hook.Timeout.Duration
+}
+
+func (hook preDeleteHook) maxAttempts() int {
+	if hook.MaxAttempts <= 0 {
+		return *preDeleteHookAttempts
+	}
+	return hook.MaxAttempts
+}
+
+// The first configured hook that applies to the PV, if any
+func preDeleteHookFor(persV v1.PersistentVolume) (preDeleteHook, bool) {
+	hooks, _ := getPreDeleteHooks()
+	for _, hook := range hooks {
+		if hook.applies(persV) {
+			return hook, true
+		}
+	}
+	return preDeleteHook{}, false
+}
+
+func preDeleteHookByName(name string) (preDeleteHook, bool) {
+	hooks, _ := getPreDeleteHooks()
+	for _, hook := range hooks {
+		if hook.Name == name {
+			return hook, true
+		}
+	}
+	return preDeleteHook{}, false
+}
+
+func getPreDeleteHookState(persV v1.PersistentVolume) (preDeleteHookState, bool) {
+	state := preDeleteHookState{}
+	value, ok := persV.ObjectMeta.Annotations[annotationPreDeleteHook]
+	if !ok {
+		return state, false
+	}
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		klog.Errorf("ERROR: invalid annotation %s on PV %s", annotationPreDeleteHook, persV.Name)
+		return preDeleteHookState{}, false
+	}
+	return state, true
+}
+
+func setPreDeleteHookState(persV v1.PersistentVolume, state preDeleteHookState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return setPVAnnotations(persV.Name, map[string]string{annotationPreDeleteHook: string(value)})
+}
+
+// Deletion guard: the pre-delete hook of the PV, if any, must have succeeded. Starts it otherwise.
+func preDeleteHookGuard(persV v1.PersistentVolume, trigger string) string {
+	if _, err := getPreDeleteHooks(); err != nil {
+		// be conservative: if we cannot tell whether a hook applies, do not delete
+		return fmt.Sprintf("invalid pre-delete hooks - %v", err)
+	}
+	hook, ok := preDeleteHookFor(persV)
+	if !ok {
+		return ""
+	}
+	state, _ := getPreDeleteHookState(persV)
+	if state.Hook != hook.Name {
+		// never run, or the configuration changed
+		state = preDeleteHookState{Hook: hook.Name}
+	}
+	switch state.Phase {
+	case hookPhaseSucceeded:
+		return ""
+	case hookPhaseFailed:
+		if state.Attempts >= hook.maxAttempts() {
+			return fmt.Sprintf("pre-delete hook %s failed %d time(s), last: %s", hook.Name, state.Attempts, state.Message)
+		}
+		if state.CompletedAt != nil && time.Since(*state.CompletedAt) < *preDeleteHookRetryDelay {
+			return fmt.Sprintf("pre-delete hook %s failed (%s), attempt %d/%d after %s", hook.Name, state.Message,
+				state.Attempts+1, hook.maxAttempts(), state.CompletedAt.Add(*preDeleteHookRetryDelay).Format(time.RFC3339))
+		}
+	case hookPhaseRunning:
+		// the PV is not bound temporarily any more (or was never): that attempt is lost
+		if state.Attempts >= hook.maxAttempts() {
+			return fmt.Sprintf("pre-delete hook %s interrupted after %d attempt(s)", hook.Name, state.Attempts)
+		}
+	}
+	if err := startPreDeleteHook(persV, hook, state); err != nil {
+		return fmt.Sprintf("cannot start pre-delete hook %s - %v", hook.Name, err)
+	}
+	return fmt.Sprintf("waiting for pre-delete hook %s (attempt %d/%d)", hook.Name, state.Attempts+1, hook.maxAttempts())
+}
+
+func preDeleteHookName(persV v1.PersistentVolume) string {
+	return "pre-delete-" + persV.Name
+}
+
+func startPreDeleteHook(persV v1.PersistentVolume, hook preDeleteHook, state preDeleteHookState) error {
+	state.Phase = hookPhaseRunning
+	state.Attempts++
+	state.Namespace = hook.namespace()
+	state.Job = fmt.Sprintf("%s-%d", preDeleteHookName(persV), state.Attempts)
+	state.StartedAt = time.Now()
+	state.CompletedAt = nil
+	state.Message = ""
+	klog.Infof("INFO: starting pre-delete hook %s of PV %s, attempt %d", hook.Name, persV.Name, state.Attempts)
+	// recorded first, so that the attempt counts even if the reclaimer stops now
+	if err := setPreDeleteHookState(persV, state); err != nil {
+		return err
+	}
+	claimRef := *persV.Spec.ClaimRef
+	if err := bindPVTemporarily(persV, temporaryBindingPreDeleteHook, state.Namespace, preDeleteHookName(persV)); err != nil {
+		return err
+	}
+	// retried by processPreDeleteHooks if it fails
+	return createPreDeleteHookJob(persV, hook, state, claimRef)
+}
+
+func createPreDeleteHookJob(persV v1.PersistentVolume, hook preDeleteHook, state preDeleteHookState, claimRef v1.ObjectReference) error {
+	template := *hook.Template.DeepCopy()
+	if template.Spec.RestartPolicy == "" {
+		template.Spec.RestartPolicy = v1.RestartPolicyNever
+	}
+	template.Spec.Volumes = append(template.Spec.Volumes, v1.Volume{
+		Name: "data",
+		VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+			ClaimName: preDeleteHookName(persV),
+			ReadOnly:  true,
+		}},
+	})
+	env := []v1.EnvVar{
+		{Name: "PV_NAME", Value: persV.Name},
+		{Name: "PVC_NAMESPACE", Value: claimRef.Namespace},
+		{Name: "PVC_NAME", Value: claimRef.Name},
+		{Name: "STORAGE_CLASS", Value: persV.Spec.StorageClassName},
+	}
+	for i := range template.Spec.Containers {
+		template.Spec.Containers[i].Env = append(template.Spec.Containers[i].Env, env...)
+	}
+	// the attempts are counted by the reclaimer
+	backoffLimit := int32(0)
+	activeDeadlineSeconds := int64(hook.timeout().Seconds())
+	job := &batch_v1.Job{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      state.Job,
+			Namespace: state.Namespace,
+			Labels:    map[string]string{managedByLabel: managedByValue},
+		},
+		Spec: batch_v1.JobSpec{
+			BackoffLimit:          &backoffLimit,
+			ActiveDeadlineSeconds: &activeDeadlineSeconds,
+			Template:              template,
+		},
+	}
+	if _, err := kubeclient.kubeclient.BatchV1().Jobs(job.Namespace).Create(job); err != nil && !api_errors.IsAlreadyExists(err) {
+		return fmt.Errorf("creating Job %s/%s - %v", job.Namespace, job.Name, err)
+	}
+	return nil
+}
+
+// Records the result of the running pre-delete hooks once their Job is over, then removes the Job and the temporary binding
+func processPreDeleteHooks() error {
+	if *preDeleteHooksFile == "" {
+		return nil
+	}
+	pvList, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, persV := range pvList.Items {
+		if binding, ok := getTemporaryBinding(persV); ok && binding.Purpose == temporaryBindingPreDeleteHook {
+			advancePreDeleteHook(persV, binding)
+		}
+	}
+	return nil
+}
+
+func advancePreDeleteHook(persV v1.PersistentVolume, binding temporaryBinding) {
+	state, ok := getPreDeleteHookState(persV)
+	if ok && state.Phase == hookPhaseRunning {
+		hook, hookExists := preDeleteHookByName(state.Hook)
+		timeout := *preDeleteHookTimeout
+		if hookExists {
+			timeout = hook.timeout()
+		}
+		job, err := kubeclient.kubeclient.BatchV1().Jobs(state.Namespace).Get(state.Job, meta_v1.GetOptions{})
+		if api_errors.IsNotFound(err) && hookExists && time.Since(state.StartedAt) < timeout {
+			if err := createPreDeleteHookJob(persV, hook, state, *binding.ClaimRef); err != nil {
+				klog.Errorf("ERROR: pre-delete hook %s of PV %s - %v", state.Hook, persV.Name, err)
+			}
+			return
+		} else if err != nil && !api_errors.IsNotFound(err) {
+			klog.Errorf("ERROR: getting Job %s/%s - %v", state.Namespace, state.Job, err)
+			return
+		}
+
+		if err != nil {
+			state.Phase, state.Message = hookPhaseFailed, fmt.Sprintf("Job %s could not be created", state.Job)
+		} else if job.Status.Succeeded > 0 {
+			state.Phase, state.Message = hookPhaseSucceeded, ""
+		} else if message, failed := jobFailed(*job); failed {
+			state.Phase, state.Message = hookPhaseFailed, message
+		} else if time.Since(state.StartedAt) > timeout+*resyncPeriod {
+			// e.g. the temporary PVC never got bound
+			state.Phase, state.Message = hookPhaseFailed, fmt.Sprintf("not completed after %v", timeout)
+		} else {
+			return
+		}
+		now := time.Now()
+		state.CompletedAt = &now
+		if err := setPreDeleteHookState(persV, state); err != nil {
+			klog.Errorf("ERROR: recording the pre-delete hook of PV %s - %v", persV.Name, err)
+			return
+		}
+		if state.Phase == hookPhaseSucceeded {
+			klog.Infof("INFO: pre-delete hook %s of PV %s succeeded", state.Hook, persV.Name)
+		} else {
+			klog.Errorf("ERROR: pre-delete hook %s of PV %s failed, attempt %d - %s", state.Hook, persV.Name, state.Attempts, state.Message)
+		}
+		recordAudit(persV, auditPreDeleteHook, state.Hook, map[string]string{"phase": state.Phase, "attempt": fmt.Sprint(state.Attempts), "job": state.Namespace + "/" + state.Job, "message": state.Message})
+	}
+
+	if state.Job != "" {
+		propagation := meta_v1.DeletePropagationBackground
+		err := kubeclient.kubeclient.BatchV1().Jobs(state.Namespace).Delete(state.Job, &meta_v1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !api_errors.IsNotFound(err) {
+			klog.Errorf("ERROR: deleting Job %s/%s - %v", state.Namespace, state.Job, err)
+			return
+		}
+	}
+	if _, err := releaseTemporaryBinding(persV); err != nil {
+		klog.Errorf("ERROR: ending the temporary binding of PV %s - %v", persV.Name, err)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// Pressure mode: when the storage is nearly full, the retained volumes that were released the longest time ago are
+// deleted before the end of their grace period, until enough capacity is freed. Volumes are never deleted less than
+// -pressureMinimumRetention after their release.
+
+// set when the reclaimer first processes a PV as Released, to know which volumes were released the longest time ago
+const annotationReleasedAt = "reclaim-volumes.cern.ch/released-at"
+
+// Where the used capacity comes from
+const (
+	pressureSignalProvisioned = "provisioned"
+	pressureSignalPrometheus  = "prometheus"
+	pressureSignalConfigMap   = "configmap"
+)
+
+var (
+	pressureSignal           = flag.String("pressureSignal", "", "enables the pressure mode with the source of the used capacity: provisioned (sum of the capacities of all PVs), prometheus (result of -pressurePrometheusQuery) or configmap (key 'used' of -pressureConfigMap). Disabled if empty")
+	pressureQuota            = flag.String("pressureQuota", "", "pressure mode: total capacity of the storage (e.g. 500Ti). The configmap signal can override it with its 'quota' key")
+	pressureThreshold        = flag.Float64("pressureThreshold", 0.9, "pressure mode: fraction of -pressureQuota above which retained volumes are deleted early")
+	pressureMinimumRetention = flag.Duration("pressureMinimumRetention", 24*time.Hour, "pressure mode: volumes are never deleted early less than this after their release")
+	pressurePrometheusURL    = flag.String("pressurePrometheusURL", "", "pressure mode: URL of the Prometheus server queried with the prometheus signal (e.g. http://prometheus:9090)")
+	pressurePrometheusQuery  = flag.String("pressurePrometheusQuery", "ceph_cluster_total_used_bytes", "pressure mode: PromQL query returning the used capacity in bytes")
+	pressureConfigMap        = flag.String("pressureConfigMap", "reclaim-volumes-pressure", "pressure mode: ConfigMap in the namespace of the reclaimer with the used capacity in its 'used' key (a quantity, e.g. 460Ti) for the configmap signal")
+)
+
+// A volume deleted early to free capacity
+type acceleratedVolume struct {
+	PersistentVolume string `json:"persistentVolume"`
+	Namespace        string `json:"namespace"`
+	ClaimName        string `json:"claimName"`
+	CapacityBytes    int64  `json:"capacityBytes"`
+	ReleasedAt       string `json:"releasedAt"`
+	Reason           string `json:"reason"`
+}
+
+// What the pressure mode decided for one run
+type pressurePlan struct {
+	UsedBytes   int64               `json:"usedBytes"`
+	QuotaBytes  int64               `json:"quotaBytes"`
+	BytesToFree int64               `json:"bytesToFree"`
+	Accelerated []acceleratedVolume `json:"accelerated"`
+}
+
+// Reasons of the PVs to delete early in the current run, by PV name
+var pressureAccelerations = map[string]string{}
+
+// When a Released PV was released: the annotation set by the reclaimer, or for the PVs released before it existed,
+// the deletion timestamp minus the grace period
+func pvReleasedAt(persV v1.PersistentVolume) (time.Time, bool) {
+	if tReleased, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationReleasedAt]); err == nil {
+		return tReleased, true
+	}
+	tDelete, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationDelete])
+	if err != nil || getPVReclaimingGracePeriod(persV) == 0 {
+		return time.Time{}, false
+	}
+	return tDelete.Add(-getPVReclaimingGracePeriod(persV)), true
+}
+
+// Records when a PV is first processed as Released
+func markPVReleased(persV v1.PersistentVolume) {
+	if _, ok := persV.ObjectMeta.Annotations[annotationReleasedAt]; ok {
+		return
+	}
+	if _, ok := persV.ObjectMeta.Annotations[annotationDelete]; ok {
+		// released before the annotation existed, see pvReleasedAt
+		return
+	}
+	setPVAnnotations(persV.Name, map[string]string{annotationReleasedAt: time.Now().Format(time.RFC3339)})
+}
+
+func pvCapacityBytes(persV v1.PersistentVolume) int64 {
+	if capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]; ok {
+		return capacity.Value()
+	}
+	return 0
+}
+
+// Queries Prometheus for a single value, from a scalar or the first sample of a vector
+func queryPrometheusValue(serverURL, query string) (float64, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(serverURL, "/") + "/api/v1/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string          `json:"resultType"`
+			Result     json.RawMessage `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("invalid Prometheus response (%s) - %v", resp.Status, err)
+	}
+	if result.Status != "success" {
+		return 0, fmt.Errorf("Prometheus query failed: %s", result.Error)
+	}
+	// a sample is [<timestamp>, "<value>"]
+	var sample []interface{}
+	switch result.Data.ResultType {
+	case "scalar":
+		err = json.Unmarshal(result.Data.Result, &sample)
+	case "vector":
+		var vector []struct {
+			Value []interface{} `json:"value"`
+		}
+		err = json.Unmarshal(result.Data.Result, &vector)
+		if err == nil && len(vector) > 0 {
+			sample = vector[0].Value
+		}
+	default:
+		return 0, fmt.Errorf("unsupported Prometheus result type '%s'", result.Data.ResultType)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(sample) != 2 {
+		return 0, fmt.Errorf("Prometheus query '%s' returned no value", query)
+	}
+	value, ok := sample[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid Prometheus sample %v", sample)
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// The used and total capacity of the storage, according to pressureSignal
+func storageUsage(pvs []v1.PersistentVolume) (used, quota int64, err error) {
+	if *pressureQuota != "" {
+		quotaQuantity, err := resource.ParseQuantity(*pressureQuota)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid -pressureQuota '%s' - %v", *pressureQuota, err)
+		}
+		quota = quotaQuantity.Value()
+	}
+
+	switch *pressureSignal {
+	case pressureSignalProvisioned:
+		for _, persV := range pvs {
+			used += pvCapacityBytes(persV)
+		}
+	case pressureSignalPrometheus:
+		value, err := queryPrometheusValue(*pressurePrometheusURL, *pressurePrometheusQuery)
+		if err != nil {
+			return 0, 0, err
+		}
+		used = int64(value)
+	case pressureSignalConfigMap:
+		configMap, err := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Get(*pressureConfigMap, meta_v1.GetOptions{})
+		if err != nil {
+			return 0, 0, err
+		}
+		usedQuantity, err := resource.ParseQuantity(configMap.Data["used"])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid 'used' in ConfigMap %s - %v", *pressureConfigMap, err)
+		}
+		used = usedQuantity.Value()
+		if value, ok := configMap.Data["quota"]; ok {
+			quotaQuantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid 'quota' in ConfigMap %s - %v", *pressureConfigMap, err)
+			}
+			quota = quotaQuantity.Value()
+		}
+	default:
+		return 0, 0, fmt.Errorf("unknown -pressureSignal '%s'", *pressureSignal)
+	}
+	if quota <= 0 {
+		return 0, 0, fmt.Errorf("no storage quota, use -pressureQuota")
+	}
+	return used, quota, nil
+}
+
+// Computes how much capacity must be freed and picks the retained volumes to delete early, released the longest time ago first.
+// Returns nil if the pressure mode is disabled.
+func planPressureReclaims(pvs []v1.PersistentVolume, now time.Time) (*pressurePlan, error) {
+	if *pressureSignal == "" {
+		return nil, nil
+	}
+	used, quota, err := storageUsage(pvs)
+	if err != nil {
+		return nil, err
+	}
+	plan := &pressurePlan{UsedBytes: used, QuotaBytes: quota, Accelerated: []acceleratedVolume{}}
+	toFree := used - int64(*pressureThreshold*float64(quota))
+
+	type candidate struct {
+		persV      v1.PersistentVolume
+		releasedAt time.Time
+	}
+	candidates := []candidate{}
+	for _, persV := range pvs {
+		// the volumes being deleted already will free their capacity
+		if pvReclaimWasRequested(persV) {
+			toFree -= pvCapacityBytes(persV)
+			continue
+		}
+		if persV.Status.Phase != v1.VolumeReleased || persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete ||
+			getPVReclaimingGracePeriod(persV) == 0 {
+			continue
+		}
+		// deleted at this run anyway
+		if tDelete, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationDelete]); err == nil && now.After(tDelete) {
+			continue
+		}
+		// a user explicitly asked to keep this volume longer
+		if _, ok := persV.ObjectMeta.Annotations[annotationRetentionExtendedBy]; ok {
+			continue
+		}
+		releasedAt, ok := pvReleasedAt(persV)
+		if !ok || now.Before(releasedAt.Add(*pressureMinimumRetention)) {
+			continue
+		}
+		candidates = append(candidates, candidate{persV, releasedAt})
+	}
+	if toFree <= 0 {
+		return plan, nil
+	}
+	plan.BytesToFree = toFree
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].releasedAt.Before(candidates[j].releasedAt) })
+	freed := int64(0)
+	for _, c := range candidates {
+		if freed >= toFree {
+			break
+		}
+		freed += pvCapacityBytes(c.persV)
+		accelerated := acceleratedVolume{
+			PersistentVolume: c.persV.Name,
+			CapacityBytes:    pvCapacityBytes(c.persV),
+			ReleasedAt:       c.releasedAt.Format(time.RFC3339),
+			Reason: fmt.Sprintf("storage pressure: %s used of %s (threshold %.0f%%), %s to free; released at %s, one of the oldest retained volumes",
+				formatBytes(used), formatBytes(quota), *pressureThreshold*100, formatBytes(toFree), c.releasedAt.Format(time.RFC3339)),
+		}
+		if c.persV.Spec.ClaimRef != nil {
+			accelerated.Namespace = c.persV.Spec.ClaimRef.Namespace
+			accelerated.ClaimName = c.persV.Spec.ClaimRef.Name
+		}
+		plan.Accelerated = append(plan.Accelerated, accelerated)
+	}
+	if freed < toFree {
+		klog.Warningf("WARNING: storage pressure: only %s of retained volumes can be deleted early, %s should be freed", formatBytes(freed), formatBytes(toFree))
+	}
+	return plan, nil
+}
+
+// Plans the early deletions of the run
+func preparePressureReclaims(pvs []v1.PersistentVolume) {
+	pressureAccelerations = map[string]string{}
+	plan, err := planPressureReclaims(pvs, time.Now())
+	if err != nil {
+		klog.Errorf("ERROR: pressure mode, no volume will be deleted early - %v", err)
+		return
+	}
+	if plan == nil {
+		return
+	}
+	setGauge("reclaim_volumes_pressure_bytes_to_free", "Capacity the pressure mode had to free at the last run", float64(plan.BytesToFree))
+	if plan.BytesToFree <= 0 {
+		return
+	}
+	klog.Infof("INFO: storage pressure: %s used of %s, %s to free by deleting %d retained volume(s) early", formatBytes(plan.UsedBytes),
+		formatBytes(plan.QuotaBytes), formatBytes(plan.BytesToFree), len(plan.Accelerated))
+	for _, accelerated := range plan.Accelerated {
+		pressureAccelerations[accelerated.PersistentVolume] = accelerated.Reason
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+var (
+	reportFormat         = flag.String("reportFormat", "markdown", "format of the report command output: markdown, csv or json")
+	reportOutput         = flag.String("reportOutput", "", "file the report command writes to. Standard output if empty")
+	reportStateConfigMap = flag.String("reportStateConfigMap", "reclaim-volumes-report-state", "ConfigMap, in the namespace of the reclaimer, where the report command remembers the volumes of the previous report to count deletions. Not used if empty")
+	reportSaveState      = flag.Bool("reportSaveState", false, "report command: remember the volumes of this report in -reportStateConfigMap, so the next one counts the deletions since it. Meant for the scheduled reports, not for the ad-hoc ones")
+)
+
+// Statistics for one storage class and namespace (of the deleted PVC)
+type reportGroup struct {
+	StorageClass           string `json:"storageClass"`
+	Namespace              string `json:"namespace"`
+	Waiting                int    `json:"waiting"`
+	CapacityBytes          int64  `json:"capacityBytes"`
+	DeletedWithin24h       int    `json:"deletedWithin24h"`
+	DeletedWithin7d        int    `json:"deletedWithin7d"`
+	DeletedSinceLastReport int    `json:"deletedSinceLastReport"`
+	InvalidAnnotations     int    `json:"invalidAnnotations"`
+	Failed                 int    `json:"failed"`
+	MissingClaim           int    `json:"missingClaim"`
+	// content found by the inspection of the waiting volumes, see inspection.go
+	Inspected    int   `json:"inspected"`
+	Empty        int   `json:"empty"`
+	ContentBytes int64 `json:"contentBytes"`
+}
+
+type invalidVolume struct {
+	PersistentVolume string   `json:"persistentVolume"`
+	Namespace        string   `json:"namespace"`
+	ClaimName        string   `json:"claimName"`
+	Annotations      []string `json:"annotations"`
+}
+
+type failedVolume struct {
+	PersistentVolume string `json:"persistentVolume"`
+	Namespace        string `json:"namespace"`
+	ClaimName        string `json:"claimName"`
+	Category         string `json:"category"`
+	Message          string `json:"message"`
+}
+
+// A Bound PV whose claim does not exist
+type missingClaimVolume struct {
+	PersistentVolume string `json:"persistentVolume"`
+	Namespace        string `json:"namespace"`
+	ClaimName        string `json:"claimName"`
+	ClaimUID         string `json:"claimUID"`
+	MissingSince     string `json:"missingSince,omitempty"`
+}
+
+type retainedVolumesReport struct {
+	GeneratedAt    time.Time            `json:"generatedAt"`
+	LastReportAt   *time.Time           `json:"lastReportAt,omitempty"`
+	Groups         []reportGroup        `json:"groups"`
+	Total          reportGroup          `json:"total"`
+	InvalidVolumes []invalidVolume      `json:"invalidVolumes"`
+	FailedVolumes  []failedVolume       `json:"failedVolumes"`
+	MissingClaims  []missingClaimVolume `json:"missingClaims"`
+	Pressure       *pressurePlan        `json:"pressure,omitempty"`
+	NamespaceUsage []namespaceUsage     `json:"namespaceUsage,omitempty"`
+	Loops          []volumeLoop         `json:"loops,omitempty"`
+}
+
+// What is remembered between reports: the group of each Released PV
+type reportState struct {
+	GeneratedAt time.Time         `json:"generatedAt"`
+	Volumes     map[string]string `json:"volumes"`
+}
+
+// report command: summary of all Released and Failed PVs, and of the Bound PVs whose claim is missing, grouped by
+// storage class and namespace
+func runReport(args []string) {
+	pvList, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+	if err != nil {
+		klog.Fatalf("ERROR: Impossible to retrieve the list of all persistent volumes - %v", err)
+	}
+	if err := listVolumeUsage(); err != nil {
+		klog.Fatalf("ERROR: Impossible to retrieve the list of all persistent volume claims - %v", err)
+	}
+
+	previous, haveState := loadReportState()
+	report, state := buildReport(pvList.Items, claims, previous, time.Now())
+	if report.Pressure, err = planPressureReclaims(pvList.Items, report.GeneratedAt); err != nil {
+		klog.Errorf("ERROR: pressure mode - %v", err)
+	}
+	if report.NamespaceUsage, err = namespaceUsageReport(pvList.Items, report.GeneratedAt); err != nil {
+		klog.Errorf("ERROR: namespace limits - %v", err)
+	}
+	report.Loops = currentVolumeLoops(pvList.Items, report.GeneratedAt)
+	if haveState {
+		report.LastReportAt = &previous.GeneratedAt
+	}
+
+	out := io.Writer(os.Stdout)
+	var file *os.File
+	if *reportOutput != "" {
+		if file, err = os.Create(*reportOutput); err != nil {
+			klog.Fatalf("ERROR: creating report file - %v", err)
+		}
+		out = file
+	}
+	switch *reportFormat {
+	case "json":
+		err = writeReportJSON(out, report)
+	case "csv":
+		err = writeReportCSV(out, report)
+	case "markdown":
+		err = writeReportMarkdown(out, report)
+	default:
+		klog.Fatalf("ERROR: unknown report format '%s'", *reportFormat)
+	}
+	if err == nil && file != nil {
+		err = file.Close()
+	}
+	if err != nil {
+		klog.Fatalf("ERROR: writing report - %v", err)
+	}
+
+	if *reportSaveState {
+		saveReportState(state)
+	}
+}
+
+func groupKey(storageClass, namespace string) string {
+	return storageClass + "/" + namespace
+}
+
+// Computes the report. Deletions are the Released PVs of the previous report that are gone or being deleted, not the ones
+// that were restored (bound again) since.
+func buildReport(pvs []v1.PersistentVolume, claims map[string]v1.PersistentVolumeClaim, previous reportState, now time.Time) (retainedVolumesReport, reportState) {
+	report := retainedVolumesReport{GeneratedAt: now, InvalidVolumes: []invalidVolume{}, FailedVolumes: []failedVolume{}, MissingClaims: []missingClaimVolume{}}
+	state := reportState{GeneratedAt: now, Volumes: map[string]string{}}
+	groups := map[string]*reportGroup{}
+	group := func(storageClass, namespace string) *reportGroup {
+		key := groupKey(storageClass, namespace)
+		if groups[key] == nil {
+			groups[key] = &reportGroup{StorageClass: storageClass, Namespace: namespace}
+		}
+		return groups[key]
+	}
+
+	stillRetained := map[string]bool{}
+	notDeleted := map[string]bool{}
+	for _, persV := range pvs {
+		if persV.Spec.PersistentVolumeReclaimPolicy != v1.PersistentVolumeReclaimDelete {
+			notDeleted[persV.Name] = true
+		}
+		namespace := ""
+		claimName := ""
+		if claimRef := userClaimRef(persV); claimRef != nil {
+			namespace = claimRef.Namespace
+			claimName = claimRef.Name
+		}
+		if persV.Status.Phase == v1.VolumeFailed {
+			group(persV.Spec.StorageClassName, namespace).Failed++
+			report.FailedVolumes = append(report.FailedVolumes, failedVolume{PersistentVolume: persV.Name, Namespace: namespace, ClaimName: claimName,
+				Category: classifyVolumeFailure(persV.Status.Message), Message: persV.Status.Message})
+			continue
+		}
+		if claimIsMissing(persV, claims) {
+			group(persV.Spec.StorageClassName, namespace).MissingClaim++
+			report.MissingClaims = append(report.MissingClaims, missingClaimVolume{PersistentVolume: persV.Name, Namespace: namespace, ClaimName: claimName,
+				ClaimUID: string(persV.Spec.ClaimRef.UID), MissingSince: persV.ObjectMeta.Annotations[annotationClaimMissingSince]})
+			continue
+		}
+		if !pvIsReleased(persV) || persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+			continue
+		}
+		stillRetained[persV.Name] = true
+		state.Volumes[persV.Name] = groupKey(persV.Spec.StorageClassName, namespace)
+
+		g := group(persV.Spec.StorageClassName, namespace)
+		g.Waiting++
+		if capacity, ok := persV.Spec.Capacity[v1.ResourceStorage]; ok {
+			g.CapacityBytes += capacity.Value()
+		}
+		if tDelete, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationDelete]); err == nil {
+			if tDelete.Before(now.Add(24 * time.Hour)) {
+				g.DeletedWithin24h++
+			}
+			if tDelete.Before(now.Add(7 * 24 * time.Hour)) {
+				g.DeletedWithin7d++
+			}
+		}
+		if content, ok := pvContent(persV); ok {
+			g.Inspected++
+			g.ContentBytes += content.Bytes
+			if content.Files == 0 {
+				g.Empty++
+			}
+		}
+		if invalid := invalidAnnotations(persV); len(invalid) > 0 {
+			g.InvalidAnnotations++
+			report.InvalidVolumes = append(report.InvalidVolumes, invalidVolume{PersistentVolume: persV.Name, Namespace: namespace, ClaimName: claimName, Annotations: invalid})
+		}
+	}
+
+	for pvName, key := range previous.Volumes {
+		if stillRetained[pvName] || notDeleted[pvName] {
+			continue
+		}
+		// storage class names cannot contain '/'
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		group(parts[0], parts[1]).DeletedSinceLastReport++
+	}
+
+	keys := []string{}
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	report.Groups = []reportGroup{}
+	for _, key := range keys {
+		g := *groups[key]
+		report.Groups = append(report.Groups, g)
+		report.Total.Waiting += g.Waiting
+		report.Total.CapacityBytes += g.CapacityBytes
+		report.Total.DeletedWithin24h += g.DeletedWithin24h
+		report.Total.DeletedWithin7d += g.DeletedWithin7d
+		report.Total.DeletedSinceLastReport += g.DeletedSinceLastReport
+		report.Total.InvalidAnnotations += g.InvalidAnnotations
+		report.Total.Failed += g.Failed
+		report.Total.MissingClaim += g.MissingClaim
+		report.Total.Inspected += g.Inspected
+		report.Total.Empty += g.Empty
+		report.Total.ContentBytes += g.ContentBytes
+	}
+	return report, state
+}
+
+// Lists the reclaim annotations of a PV that are set but cannot be used
+func invalidAnnotations(persV v1.PersistentVolume) []string {
+	invalid := []string{}
+	annotations := persV.ObjectMeta.Annotations
+	if value, ok := annotations[annotationPeriodReclaimVolumesAfterRelease]; ok {
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			invalid = append(invalid, annotationPeriodReclaimVolumesAfterRelease)
+		}
+	}
+	if value, ok := annotations[annotationNoGracePeriodSinceCreation]; ok {
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			invalid = append(invalid, annotationNoGracePeriodSinceCreation)
+		}
+	}
+	if value, ok := annotations[annotationGracePeriodOverride]; ok {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			invalid = append(invalid, annotationGracePeriodOverride)
+		}
+	}
+	if value, ok := annotations[annotationDelete]; ok {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			invalid = append(invalid, annotationDelete)
+		}
+	}
+	return invalid
+}
+
+func loadReportState() (reportState, bool) {
+	state := reportState{}
+	if *reportStateConfigMap == "" {
+		return state, false
+	}
+	configMap, err := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace()).Get(*reportStateConfigMap, meta_v1.GetOptions{})
+	if err != nil {
+		if !api_errors.IsNotFound(err) {
+			klog.Errorf("ERROR: reading report state - %v", err)
+		}
+		return state, false
+	}
+	if err := json.Unmarshal([]byte(configMap.Data["state"]), &state); err != nil {
+		klog.Errorf("ERROR: invalid report state in ConfigMap %s - %v", *reportStateConfigMap, err)
+		return reportState{}, false
+	}
+	return state, true
+}
+
+func saveReportState(state reportState) {
+	if *reportStateConfigMap == "" {
+		return
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	configMaps := kubeclient.kubeclient.CoreV1().ConfigMaps(currentNamespace())
+	configMap, err := configMaps.Get(*reportStateConfigMap, meta_v1.GetOptions{})
+	if api_errors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: *reportStateConfigMap, Labels: map[string]string{managedByLabel: managedByValue}}}
+		configMap.Data = map[string]string{"state": string(value)}
+		_, err = configMaps.Create(configMap)
+	} else if err == nil {
+		configMap.Data = map[string]string{"state": string(value)}
+		_, err = configMaps.Update(configMap)
+	}
+	if err != nil {
+		klog.Errorf("ERROR: saving report state - %v", err)
+	}
+}
+
+func formatBytes(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+func writeReportJSON(out io.Writer, report retainedVolumesReport) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+var reportColumns = []string{"Storage class", "Namespace", "Waiting", "Capacity", "Deleted within 24h", "Deleted within 7d", "Deleted since last report", "Invalid annotations", "Failed", "Claim missing", "Inspected", "Empty", "Content"}
+
+func reportRow(g reportGroup) []string {
+	return []string{g.StorageClass, g.Namespace, fmt.Sprint(g.Waiting), formatBytes(g.CapacityBytes), fmt.Sprint(g.DeletedWithin24h),
+		fmt.Sprint(g.DeletedWithin7d), fmt.Sprint(g.DeletedSinceLastReport), fmt.Sprint(g.InvalidAnnotations), fmt.Sprint(g.Failed), fmt.Sprint(g.MissingClaim),
+		fmt.Sprint(g.Inspected), fmt.Sprint(g.Empty), formatBytes(g.ContentBytes)}
+}
+
+var invalidVolumeColumns = []string{"Persistent volume", "Namespace", "Claim", "Invalid annotations"}
+
+// The groups and their total, then the volumes with invalid annotations, each with their header row
+func writeReportCSV(out io.Writer, report retainedVolumesReport) error {
+	writer := csv.NewWriter(out)
+	writer.Write(reportColumns)
+	for _, g := range report.Groups {
+		writer.Write(reportRow(g))
+	}
+	total := report.Total
+	total.StorageClass = "Total"
+	writer.Write(reportRow(total))
+
+	writer.Write(invalidVolumeColumns)
+	for _, invalid := range report.InvalidVolumes {
+		writer.Write([]string{invalid.PersistentVolume, invalid.Namespace, invalid.ClaimName, strings.Join(invalid.Annotations, " ")})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Keeps the first error of the writes to out, so that they do not need to be checked one by one
+type errWriter struct {
+	out io.Writer
+	err error
+}
+
+func (writer *errWriter) Write(p []byte) (int, error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	n, err := writer.out.Write(p)
+	writer.err = err
+	return n, err
+}
+
+func writeReportMarkdown(output io.Writer, report retainedVolumesReport) error {
+	writer := &errWriter{out: output}
+	out := io.Writer(writer)
+	fmt.Fprintf(out, "# Retained volumes report - %s\n\n", report.GeneratedAt.Format(time.RFC3339))
+	if report.LastReportAt != nil {
+		fmt.Fprintf(out, "Deletions are counted since the previous report of %s.\n\n", report.LastReportAt.Format(time.RFC3339))
+	}
+	writeRow := func(cells []string) {
+		fmt.Fprint(out, "|")
+		for _, cell := range cells {
+			fmt.Fprintf(out, " %s |", cell)
+		}
+		fmt.Fprintln(out)
+	}
+	writeRow(reportColumns)
+	separator := make([]string, len(reportColumns))
+	for i := range separator {
+		separator[i] = "---"
+	}
+	writeRow(separator)
+	for _, g := range report.Groups {
+		writeRow(reportRow(g))
+	}
+	total := report.Total
+	total.StorageClass = "**Total**"
+	writeRow(reportRow(total))
+
+	if len(report.InvalidVolumes) > 0 {
+		fmt.Fprintf(out, "\n## Volumes with invalid annotations\n\n")
+		for _, invalid := range report.InvalidVolumes {
+			fmt.Fprintf(out, "- `%s` (PVC %s/%s): %v\n", invalid.PersistentVolume, invalid.Namespace, invalid.ClaimName, invalid.Annotations)
+		}
+	}
+
+	if len(report.FailedVolumes) > 0 {
+		fmt.Fprintf(out, "\n## Failed volumes\n\n")
+		for _, failed := range report.FailedVolumes {
+			fmt.Fprintf(out, "- `%s` (PVC %s/%s), %s: %s\n", failed.PersistentVolume, failed.Namespace, failed.ClaimName, failed.Category, failed.Message)
+		}
+	}
+
+	if len(report.Loops) > 0 {
+		fmt.Fprintf(out, "\n## Create/delete loops\n\n")
+		for _, loop := range report.Loops {
+			fmt.Fprintf(out, "- namespace %s: %v\n", loop.Namespace, loop)
+		}
+	}
+
+	if len(report.NamespaceUsage) > 0 {
+		fmt.Fprintf(out, "\n## Retained volumes by namespace\n\n| Namespace | Volumes | Capacity | Volume limit | Capacity limit | Over limit |\n| --- | --- | --- | --- | --- | --- |\n")
+		for _, usage := range report.NamespaceUsage {
+			countLimit, capacityLimit := "-", "-"
+			if usage.CountLimit > 0 {
+				countLimit = fmt.Sprint(usage.CountLimit)
+			}
+			if usage.CapacityLimitBytes > 0 {
+				capacityLimit = formatBytes(usage.CapacityLimitBytes)
+			}
+			fmt.Fprintf(out, "| %s | %d | %s | %s | %s | %v |\n", usage.Namespace, usage.Count, formatBytes(usage.CapacityBytes), countLimit, capacityLimit, usage.OverLimit)
+		}
+	}
+
+	if report.Pressure != nil {
+		fmt.Fprintf(out, "\n## Storage pressure\n\n%s used of %s", formatBytes(report.Pressure.UsedBytes), formatBytes(report.Pressure.QuotaBytes))
+		if report.Pressure.BytesToFree <= 0 {
+			fmt.Fprintf(out, ", no volume needs to be deleted early.\n")
+		} else {
+			fmt.Fprintf(out, ", %s to free. Volumes deleted early at the next run:\n\n", formatBytes(report.Pressure.BytesToFree))
+			for _, accelerated := range report.Pressure.Accelerated {
+				fmt.Fprintf(out, "- `%s` (PVC %s/%s, %s), released at %s\n", accelerated.PersistentVolume, accelerated.Namespace, accelerated.ClaimName,
+					formatBytes(accelerated.CapacityBytes), accelerated.ReleasedAt)
+			}
+		}
+	}
+
+	if len(report.MissingClaims) > 0 {
+		fmt.Fprintf(out, "\n## Bound volumes whose claim is missing\n\n")
+		for _, missing := range report.MissingClaims {
+			since := ""
+			if missing.MissingSince != "" {
+				since = ", missing since " + missing.MissingSince
+			}
+			fmt.Fprintf(out, "- `%s` (PVC %s/%s, UID %s%s)\n", missing.PersistentVolume, missing.Namespace, missing.ClaimName, missing.ClaimUID, since)
+		}
+	}
+	return writer.err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Fails every write once limit bytes were written
+type failingWriter struct {
+	limit int
+}
+
+func (writer *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > writer.limit {
+		return 0, errors.New("no space left on device")
+	}
+	writer.limit -= len(p)
+	return len(p), nil
+}
+
+func TestWriteReportPropagatesWriteErrors(t *testing.T) {
+	report := retainedVolumesReport{GeneratedAt: time.Now(), Groups: []reportGroup{{StorageClass: "cephfs", Namespace: "project", Waiting: 1}}}
+	for _, write := range []func(*failingWriter) error{
+		func(out *failingWriter) error { return writeReportMarkdown(out, report) },
+		func(out *failingWriter) error { return writeReportCSV(out, report) },
+		func(out *failingWriter) error { return writeReportJSON(out, report) },
+	} {
+		if err := write(&failingWriter{limit: 10}); err == nil {
+			t.Errorf("write error not reported")
+		}
+		if err := write(&failingWriter{limit: 1 << 20}); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
+
+func testReportPV(name, storageClass, namespace string, phase v1.PersistentVolumePhase, annotations map[string]string) v1.PersistentVolume {
+	return v1.PersistentVolume{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Annotations: annotations},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName:              storageClass,
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			ClaimRef:                      &v1.ObjectReference{Namespace: namespace, Name: "data-" + name, UID: types.UID("uid-" + name)},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: phase},
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	now := time.Now()
+	deleteIn := func(d time.Duration) map[string]string {
+		return map[string]string{annotationDelete: now.Add(d).Format(time.RFC3339)}
+	}
+	deleting := testReportPV("pv-deleting", "cephfs", "project", v1.VolumeReleased, nil)
+	deleting.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimDelete
+	restored := testReportPV("pv-restored", "cephfs", "project", v1.VolumeBound, nil)
+	invalid := testReportPV("pv-invalid", "manila", "other", v1.VolumeReleased, map[string]string{annotationPeriodReclaimVolumesAfterRelease: "soon"})
+	pvs := []v1.PersistentVolume{
+		testReportPV("pv-tomorrow", "cephfs", "project", v1.VolumeReleased, deleteIn(2*time.Hour)),
+		testReportPV("pv-next-days", "cephfs", "project", v1.VolumeReleased, deleteIn(3*24*time.Hour)),
+		testReportPV("pv-later", "manila", "other", v1.VolumeReleased, deleteIn(10*24*time.Hour)),
+		invalid, deleting, restored,
+	}
+	claims := map[string]v1.PersistentVolumeClaim{
+		"project/data-pv-restored": {ObjectMeta: meta_v1.ObjectMeta{UID: "uid-pv-restored"}},
+	}
+	previous := reportState{GeneratedAt: now.Add(-24 * time.Hour), Volumes: map[string]string{
+		"pv-tomorrow": "cephfs/project",
+		"pv-gone":     "cephfs/project",
+		"pv-deleting": "cephfs/project",
+		"pv-restored": "cephfs/project",
+	}}
+
+	report, state := buildReport(pvs, claims, previous, now)
+
+	expected := []reportGroup{
+		{StorageClass: "cephfs", Namespace: "project", Waiting: 2, CapacityBytes: 2 << 30, DeletedWithin24h: 1, DeletedWithin7d: 2, DeletedSinceLastReport: 2},
+		{StorageClass: "manila", Namespace: "other", Waiting: 2, CapacityBytes: 2 << 30, InvalidAnnotations: 1},
+	}
+	if !reflect.DeepEqual(report.Groups, expected) {
+		t.Errorf("groups are %+v, expected %+v", report.Groups, expected)
+	}
+	if report.Total.Waiting != 4 || report.Total.DeletedWithin24h != 1 || report.Total.DeletedWithin7d != 2 || report.Total.DeletedSinceLastReport != 2 {
+		t.Errorf("unexpected total %+v", report.Total)
+	}
+	if len(report.InvalidVolumes) != 1 || report.InvalidVolumes[0].PersistentVolume != "pv-invalid" {
+		t.Errorf("invalid volumes are %+v, expected pv-invalid", report.InvalidVolumes)
+	}
+	if len(state.Volumes) != 4 || state.Volumes["pv-later"] != "manila/other" {
+		t.Errorf("unexpected state %+v", state.Volumes)
+	}
+}
+
+func TestWriteReportCSVHasTotalAndInvalidVolumes(t *testing.T) {
+	report := retainedVolumesReport{
+		GeneratedAt:    time.Now(),
+		Groups:         []reportGroup{{StorageClass: "cephfs", Namespace: "project", Waiting: 1}},
+		Total:          reportGroup{Waiting: 1},
+		InvalidVolumes: []invalidVolume{{PersistentVolume: "pv-invalid", Namespace: "project", ClaimName: "data", Annotations: []string{annotationDelete}}},
+	}
+	var out bytes.Buffer
+	if err := writeReportCSV(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"\nTotal,,1,", "\npv-invalid,project,data," + annotationDelete + "\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("%q not found in the CSV report:\n%s", expected, out.String())
+		}
+	}
+}
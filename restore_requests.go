@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	restoreRequestsPlural = "volumerestorerequests"
+
+	// set on PVCs created by the reclaimer to restore a volume
+	annotationRestoredBy = "reclaim-volumes.cern.ch/restored-by-request"
+	// set on PVs being restored: the UID of their deleted PVC, to put it back if the new PVC is not created
+	annotationRestoringClaimUID = "reclaim-volumes.cern.ch/restoring-claim-uid"
+)
+
+// VolumeRestoreRequest is created by a project member in their namespace to get back the data of a PVC they deleted,
+// as long as the Released PV has not been deleted yet.
+type VolumeRestoreRequest struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+	Spec               VolumeRestoreRequestSpec   `json:"spec"`
+	Status             VolumeRestoreRequestStatus `json:"status,omitempty"`
+}
+
+type VolumeRestoreRequestSpec struct {
+	// name of the deleted PVC, in the namespace of the request. The restored PVC gets the same name.
+	ClaimName string `json:"claimName"`
+	// optional, to choose between several Released PVs that were bound to a PVC with the same name
+	PersistentVolumeName string `json:"persistentVolumeName,omitempty"`
+}
+
+type VolumeRestoreRequestStatus struct {
+	Phase                string             `json:"phase,omitempty"`
+	PersistentVolumeName string             `json:"persistentVolumeName,omitempty"`
+	Conditions           []RequestCondition `json:"conditions,omitempty"`
+}
+
+type VolumeRestoreRequestList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata,omitempty"`
+	Items            []VolumeRestoreRequest `json:"items"`
+}
+
+// Processes all VolumeRestoreRequests that have not completed or failed yet
+func processRestoreRequests() error {
+	requests := VolumeRestoreRequestList{}
+	if err := listCustomResources(restoreRequestsPlural, &requests); err != nil {
+		return err
+	}
+
+	var pvList *v1.PersistentVolumeList
+	for _, request := range requests.Items {
+		if request.Status.Phase == requestPhaseCompleted || request.Status.Phase == requestPhaseFailed {
+			continue
+		}
+		// only list PVs when there is actually something to restore
+		if pvList == nil {
+			var err error
+			pvList, err = kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+			if err != nil {
+				return err
+			}
+		}
+
+		processRestoreRequest(request, pvList.Items)
+
+		if err := updateCustomResourceStatus(restoreRequestsPlural, request.Namespace, request.Name, request); err != nil {
+			klog.Errorf("ERROR: updating status of VolumeRestoreRequest %s/%s - %v", request.Namespace, request.Name, err)
+		}
+	}
+	return nil
+}
+
+// Moves a restore request one step forward and reports the progress in its status (the caller saves it)
+func processRestoreRequest(request VolumeRestoreRequest, pvs []v1.PersistentVolume) {
+	status := &request.Status
+	failed := func(reason, message string) {
+		klog.Infof("INFO: VolumeRestoreRequest %s/%s failed: %s", request.Namespace, request.Name, message)
+		status.Phase = requestPhaseFailed
+		status.Conditions = setRequestCondition(status.Conditions, "Ready", "False", reason, message)
+	}
+
+	if request.Spec.ClaimName == "" {
+		failed("InvalidSpec", "spec.claimName must be set")
+		return
+	}
+
+	// A PVC with that name exists: either we created it and wait for it to be bound, or the user re-created it.
+	pvc, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims(request.Namespace).Get(request.Spec.ClaimName, meta_v1.GetOptions{})
+	if err == nil {
+		if status.PersistentVolumeName == "" || pvc.Spec.VolumeName != status.PersistentVolumeName {
+			failed("ClaimExists", fmt.Sprintf("a PVC named %s already exists in the namespace, it must be deleted before its previous volume can be restored", pvc.Name))
+			return
+		}
+		if pvc.Status.Phase == v1.ClaimBound {
+			if err := finishPVRestore(status.PersistentVolumeName); err != nil {
+				return
+			}
+			klog.Infof("INFO: VolumeRestoreRequest %s/%s completed, PV %s is bound to PVC %s again", request.Namespace, request.Name, status.PersistentVolumeName, pvc.Name)
+			status.Phase = requestPhaseCompleted
+			status.Conditions = setRequestCondition(status.Conditions, "Ready", "True", "Bound", fmt.Sprintf("PVC %s is bound to PV %s", pvc.Name, status.PersistentVolumeName))
+			return
+		}
+		status.Conditions = setRequestCondition(status.Conditions, "Ready", "False", "WaitingForBinding", fmt.Sprintf("waiting for PVC %s to be bound to PV %s", pvc.Name, status.PersistentVolumeName))
+		return
+	} else if !api_errors.IsNotFound(err) {
+		klog.Errorf("ERROR: getting PVC %s/%s - %v", request.Namespace, request.Spec.ClaimName, err)
+		return
+	}
+
+	persV, found := findVolumeToRestore(request, pvs)
+	if !found {
+		failed("VolumeNotFound", fmt.Sprintf("no retained volume was found for a deleted PVC %s in this namespace, it may have been reclaimed already", request.Spec.ClaimName))
+		return
+	}
+	status.PersistentVolumeName = persV.Name
+	status.Conditions = setRequestCondition(status.Conditions, "VolumeFound", "True", "Found", fmt.Sprintf("PV %s was bound to PVC %s", persV.Name, request.Spec.ClaimName))
+
+	if binding, ok := getTemporaryBinding(persV); ok {
+		// inspected, debugged or archived by a pre-delete hook: retried once it is Released again
+		status.Phase = requestPhaseInProgress
+		status.Conditions = setRequestCondition(status.Conditions, "Ready", "False", "TemporarilyBound",
+			fmt.Sprintf("PV %s is in use by the administrators (%s) since %s, it will be restored afterwards", persV.Name, binding.Purpose, binding.Since.Format(time.RFC3339)))
+		return
+	}
+
+	if persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+		failed("DeletionInProgress", fmt.Sprintf("PV %s is already being deleted", persV.Name))
+		return
+	}
+
+	// Forget the UID of the deleted PVC so the PV can bind to a new PVC with the same namespace/name,
+	// then create that PVC. The PV controller does the actual binding.
+	klog.Infof("INFO: restoring PV %s for VolumeRestoreRequest %s/%s", persV.Name, request.Namespace, request.Name)
+	if _, ok := persV.ObjectMeta.Annotations[annotationRestoringClaimUID]; !ok && persV.Spec.ClaimRef.UID != "" {
+		if err := patchPVForRebinding(persV); err != nil {
+			status.Phase = requestPhaseInProgress
+			status.Conditions = setRequestCondition(status.Conditions, "Ready", "False", "RebindingError", "the volume could not be prepared for rebinding, will retry")
+			return
+		}
+		if persV.ObjectMeta.Annotations == nil {
+			persV.ObjectMeta.Annotations = map[string]string{}
+		}
+		persV.ObjectMeta.Annotations[annotationRestoringClaimUID] = string(persV.Spec.ClaimRef.UID)
+	}
+	if _, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims(request.Namespace).Create(claimForRestoredVolume(request, persV)); err != nil {
+		klog.Errorf("ERROR: creating PVC %s/%s to restore PV %s - %v", request.Namespace, request.Spec.ClaimName, persV.Name, err)
+		// Released again until the next attempt, not left Available without deletion timestamp
+		rollbackPVRebinding(persV)
+		status.Phase = requestPhaseInProgress
+		status.Conditions = setRequestCondition(status.Conditions, "Ready", "False", "ClaimCreationError", "the PVC could not be created, will retry")
+		return
+	}
+	recordAudit(persV, auditRestored, fmt.Sprintf("VolumeRestoreRequest %s/%s", request.Namespace, request.Name), map[string]string{"claim": request.Namespace + "/" + request.Spec.ClaimName})
+	status.Phase = requestPhaseInProgress
+	status.Conditions = setRequestCondition(status.Conditions, "Ready", "False", "WaitingForBinding", fmt.Sprintf("PVC %s created, waiting for it to be bound to PV %s", request.Spec.ClaimName, persV.Name))
+}
+
+// Finds the PV whose claimRef matched the namespace/name of the request. If there are several (a PVC with the same
+// name created and deleted several times), the most recent one is used unless the request names one explicitly.
+func findVolumeToRestore(request VolumeRestoreRequest, pvs []v1.PersistentVolume) (v1.PersistentVolume, bool) {
+	var candidate v1.PersistentVolume
+	found := false
+	for _, persV := range pvs {
+		claimRef := userClaimRef(persV)
+		if claimRef == nil || claimRef.Namespace != request.Namespace || claimRef.Name != request.Spec.ClaimName {
+			continue
+		}
+		if request.Spec.PersistentVolumeName != "" && persV.Name != request.Spec.PersistentVolumeName {
+			continue
+		}
+		// Available with an empty claimRef UID means we already prepared it for rebinding in a previous iteration
+		if !pvIsReleased(persV) && !(persV.Status.Phase == v1.VolumeAvailable && claimRef.UID == "") {
+			continue
+		}
+		if !found || candidate.CreationTimestamp.Before(&persV.CreationTimestamp) {
+			candidate = persV
+			found = true
+		}
+	}
+	return candidate, found
+}
+
+// The restored PVC is pre-bound to the PV and requests exactly what the PV provides
+func claimForRestoredVolume(request VolumeRestoreRequest, persV v1.PersistentVolume) *v1.PersistentVolumeClaim {
+	storageClassName := persV.Spec.StorageClassName
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:        request.Spec.ClaimName,
+			Namespace:   request.Namespace,
+			Annotations: map[string]string{annotationRestoredBy: request.Name},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: persV.Spec.AccessModes,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: persV.Spec.Capacity[v1.ResourceStorage]},
+			},
+			VolumeName:       persV.Name,
+			StorageClassName: &storageClassName,
+			VolumeMode:       persV.Spec.VolumeMode,
+		},
+	}
+}
+
+// Follows up on the PVs prepared for rebinding by a restore request, whatever became of the request: clears their
+// reclaim annotations once they are bound to the new PVC, and makes them Released again if that PVC was never created.
+// Returns true while the PV is being restored, it must not be reclaimed then.
+func checkRestoringVolume(persV v1.PersistentVolume) bool {
+	originalUID, ok := persV.ObjectMeta.Annotations[annotationRestoringClaimUID]
+	if !ok {
+		return false
+	}
+	switch {
+	case persV.Status.Phase == v1.VolumeBound && persV.Spec.ClaimRef != nil && string(persV.Spec.ClaimRef.UID) != originalUID:
+		klog.Infof("INFO: PV %s is bound to its restored PVC %s/%s", persV.Name, persV.Spec.ClaimRef.Namespace, persV.Spec.ClaimRef.Name)
+		finishPVRestore(persV.Name)
+		return true
+	case persV.Status.Phase == v1.VolumeAvailable && persV.Spec.ClaimRef != nil:
+		_, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims(persV.Spec.ClaimRef.Namespace).Get(persV.Spec.ClaimRef.Name, meta_v1.GetOptions{})
+		if api_errors.IsNotFound(err) {
+			klog.Infof("INFO: PVC %s/%s to restore PV %s was not created, making the PV Released again", persV.Spec.ClaimRef.Namespace, persV.Spec.ClaimRef.Name, persV.Name)
+			rollbackPVRebinding(persV)
+		} else if err != nil {
+			klog.Errorf("ERROR: getting PVC %s/%s - %v", persV.Spec.ClaimRef.Namespace, persV.Spec.ClaimRef.Name, err)
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	retentionExtensionsPlural = "volumeretentionextensions"
+
+	// who asked for the last retention extension of the PV, and why
+	annotationRetentionExtendedBy      = "reclaim-volumes.cern.ch/retention-extended-by"
+	annotationRetentionExtensionReason = "reclaim-volumes.cern.ch/retention-extension-reason"
+	// deletion time of the PV before its first retention extension, all the extensions together are bounded from it
+	annotationOriginalDeletion = "reclaim-volumes.cern.ch/original-deletion-timestamp"
+)
+
+var maxRetentionExtension = flag.Duration("maxRetentionExtension", 30*24*time.Hour, "maximum extension users can get with a VolumeRetentionExtension. The deletion of a PV is never postponed, by all its extensions together, to more than this duration after the deletion time it had before the first one")
+
+// VolumeRetentionExtension is created by a project member in their namespace to keep the retained volume of a deleted
+// PVC for longer than its grace period (e.g. while a migration is in progress).
+type VolumeRetentionExtension struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata,omitempty"`
+	Spec               VolumeRetentionExtensionSpec   `json:"spec"`
+	Status             VolumeRetentionExtensionStatus `json:"status,omitempty"`
+}
+
+type VolumeRetentionExtensionSpec struct {
+	// name of the deleted PVC, in the namespace of the request
+	ClaimName string `json:"claimName"`
+	// optional, to only extend one of several Released PVs that were bound to a PVC with the same name
+	PersistentVolumeName string `json:"persistentVolumeName,omitempty"`
+	// how much longer the volume should be kept, as a Go duration (e.g. 168h)
+	Extension string `json:"extension"`
+	Reason    string `json:"reason"`
+	// the person to contact about this extension
+	RequestedBy string `json:"requestedBy,omitempty"`
+}
+
+type VolumeRetentionExtensionStatus struct {
+	Phase      string             `json:"phase,omitempty"`
+	Volumes    []ExtendedVolume   `json:"volumes,omitempty"`
+	Conditions []RequestCondition `json:"conditions,omitempty"`
+}
+
+type ExtendedVolume struct {
+	PersistentVolumeName string `json:"persistentVolumeName"`
+	DeletionTimestamp    string `json:"deletionTimestamp"`
+}
+
+type VolumeRetentionExtensionList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata,omitempty"`
+	Items            []VolumeRetentionExtension `json:"items"`
+}
+
+// Applies all VolumeRetentionExtensions that have not been processed yet. Each request is applied only once.
+func processRetentionExtensionRequests() error {
+	requests := VolumeRetentionExtensionList{}
+	if err := listCustomResources(retentionExtensionsPlural, &requests); err != nil {
+		return err
+	}
+
+	var pvList *v1.PersistentVolumeList
+	for _, request := range requests.Items {
+		if request.Status.Phase == requestPhaseCompleted || request.Status.Phase == requestPhaseFailed {
+			continue
+		}
+		if pvList == nil {
+			var err error
+			pvList, err = kubeclient.kubeclient.CoreV1().PersistentVolumes().List(meta_v1.ListOptions{})
+			if err != nil {
+				return err
+			}
+		}
+
+		processRetentionExtensionRequest(request, pvList.Items)
+
+		if err := updateCustomResourceStatus(retentionExtensionsPlural, request.Namespace, request.Name, request); err != nil {
+			klog.Errorf("ERROR: updating status of VolumeRetentionExtension %s/%s - %v", request.Namespace, request.Name, err)
+		}
+	}
+	return nil
+}
+
+func processRetentionExtensionRequest(request VolumeRetentionExtension, pvs []v1.PersistentVolume) {
+	status := &request.Status
+	failed := func(reason, message string) {
+		klog.Infof("INFO: VolumeRetentionExtension %s/%s failed: %s", request.Namespace, request.Name, message)
+		status.Phase = requestPhaseFailed
+		status.Conditions = setRequestCondition(status.Conditions, "Applied", "False", reason, message)
+	}
+
+	extension, err := time.ParseDuration(request.Spec.Extension)
+	if err != nil || extension <= 0 {
+		failed("InvalidSpec", fmt.Sprintf("spec.extension '%s' is not a valid positive duration (e.g. 168h)", request.Spec.Extension))
+		return
+	}
+	if request.Spec.ClaimName == "" || request.Spec.Reason == "" {
+		failed("InvalidSpec", "spec.claimName and spec.reason must be set")
+		return
+	}
+	message := ""
+	if extension > *maxRetentionExtension {
+		extension = *maxRetentionExtension
+		message = fmt.Sprintf("extension reduced to the maximum of %v. ", *maxRetentionExtension)
+	}
+
+	// who asked: the request itself, plus the contact given in the request if any
+	requestedBy := fmt.Sprintf("%s/%s", request.Namespace, request.Name)
+	if request.Spec.RequestedBy != "" {
+		requestedBy = fmt.Sprintf("%s (%s)", requestedBy, request.Spec.RequestedBy)
+	}
+
+	status.Volumes = nil
+	for _, persV := range pvs {
+		// the annotations of a PV bound temporarily (e.g. being inspected) are kept when it is Released again
+		claimRef := userClaimRef(persV)
+		if !pvIsReleased(persV) || claimRef == nil || claimRef.Namespace != request.Namespace || claimRef.Name != request.Spec.ClaimName {
+			continue
+		}
+		if request.Spec.PersistentVolumeName != "" && persV.Name != request.Spec.PersistentVolumeName {
+			continue
+		}
+		if persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+			message += fmt.Sprintf("PV %s is already being deleted. ", persV.Name)
+			continue
+		}
+
+		if persV.ObjectMeta.Annotations[annotationRetentionExtendedBy] == requestedBy {
+			// already extended by this request in a previous run that could not complete
+			status.Volumes = append(status.Volumes, ExtendedVolume{PersistentVolumeName: persV.Name, DeletionTimestamp: persV.ObjectMeta.Annotations[annotationDelete]})
+			continue
+		}
+
+		deletion, original, ok := extendedDeletionTime(persV, extension)
+		if !ok {
+			message += fmt.Sprintf("PV %s is not scheduled for deletion. ", persV.Name)
+			continue
+		}
+
+		klog.Infof("INFO: extending retention of PV %s until %v as requested by %s: %s", persV.Name, deletion, requestedBy, request.Spec.Reason)
+		err := setPVAnnotations(persV.Name, map[string]string{
+			annotationDelete:                   deletion.Format(time.RFC3339),
+			annotationOriginalDeletion:         original.Format(time.RFC3339),
+			annotationRetentionExtendedBy:      requestedBy,
+			annotationRetentionExtensionReason: request.Spec.Reason,
+		})
+		if err != nil {
+			// retried at the next run
+			status.Conditions = setRequestCondition(status.Conditions, "Applied", "False", "PatchError", fmt.Sprintf("PV %s could not be updated, will retry", persV.Name))
+			return
+		}
+		recordAudit(persV, auditRetentionExtended, request.Spec.Reason, map[string]string{
+			annotationDelete:              deletion.Format(time.RFC3339),
+			annotationRetentionExtendedBy: requestedBy,
+		})
+		// the owners learn the new deletion date
+		queueNotification(persV, notificationScheduled, deletion.Format(time.RFC3339))
+		status.Volumes = append(status.Volumes, ExtendedVolume{PersistentVolumeName: persV.Name, DeletionTimestamp: deletion.Format(time.RFC3339)})
+	}
+
+	if len(status.Volumes) == 0 {
+		failed("VolumeNotFound", message+fmt.Sprintf("no retained volume to extend was found for a deleted PVC %s in this namespace", request.Spec.ClaimName))
+		return
+	}
+	status.Phase = requestPhaseCompleted
+	status.Conditions = setRequestCondition(status.Conditions, "Applied", "True", "Extended", message+fmt.Sprintf("retention of %d volume(s) extended", len(status.Volumes)))
+}
+
+// Computes the new deletion time of a PV extended by the given duration, never more than maxRetentionExtension after
+// its deletion time before any extension (also returned, to be kept on the PV) and never earlier than what is already
+// set, so that repeated requests cannot keep a volume forever. Returns false if the PV is not subject to reclaiming.
+func extendedDeletionTime(persV v1.PersistentVolume, extension time.Duration) (time.Time, time.Time, bool) {
+	current, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationDelete])
+	if err != nil {
+		// not stamped yet: start from the deletion time the next run would set
+		gracePeriod := getPVReclaimingGracePeriod(persV)
+		if gracePeriod == 0 {
+			return time.Time{}, time.Time{}, false
+		}
+		current = time.Now().Add(gracePeriod)
+	}
+	original, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationOriginalDeletion])
+	if err != nil || original.After(current) {
+		original = current
+	}
+
+	deletion := current.Add(extension)
+	if limit := original.Add(*maxRetentionExtension); deletion.After(limit) {
+		deletion = limit
+	}
+	if deletion.Before(current) {
+		deletion = current
+	}
+	return deletion, original, true
+}
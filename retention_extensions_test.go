@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExtendedDeletionTimeIsBoundedFromTheOriginalDeletion(t *testing.T) {
+	*maxRetentionExtension = 30 * 24 * time.Hour
+	original := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	persV := v1.PersistentVolume{ObjectMeta: meta_v1.ObjectMeta{Name: "pv-test", Annotations: map[string]string{
+		annotationDelete: original.Format(time.RFC3339),
+	}}}
+
+	// repeated extensions of 20 days: the second one only gets the remaining 10 days
+	for i, expected := range []time.Time{original.Add(20 * 24 * time.Hour), original.Add(30 * 24 * time.Hour), original.Add(30 * 24 * time.Hour)} {
+		deletion, fromOriginal, ok := extendedDeletionTime(persV, 20*24*time.Hour)
+		if !ok {
+			t.Fatalf("extension %d: PV not scheduled for deletion", i)
+		}
+		if !deletion.Equal(expected) || !fromOriginal.Equal(original) {
+			t.Errorf("extension %d: deletion at %v from %v, expected %v from %v", i, deletion, fromOriginal, expected, original)
+		}
+		persV.ObjectMeta.Annotations[annotationDelete] = deletion.Format(time.RFC3339)
+		persV.ObjectMeta.Annotations[annotationOriginalDeletion] = fromOriginal.Format(time.RFC3339)
+	}
+}
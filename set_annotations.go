@@ -1,32 +1,109 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
+	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 )
 
-// Sets annotations to the Persistent Volume
-func setPVDateAnnotation(pvName, annotationKey string, date time.Time) error {
+// Sets annotations to the Persistent Volume, and records why in the audit trail
+func setPVDateAnnotation(persV v1.PersistentVolume, annotationKey string, date time.Time, reason string) error {
 	// use the same RFC3339 date format as Kubernetes already uses for all date representation on resources.
 	patch := []byte(fmt.Sprintf(`{"metadata": {"annotations": {"%s": "%s"}}}`, annotationKey, date.Format(time.RFC3339)))
-	_, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(pvName, types.StrategicMergePatchType, patch)
+	_, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(persV.Name, types.StrategicMergePatchType, patch)
 	if err != nil {
 		klog.Errorf("ERROR: patching annotation PV %s", err)
 		return err
 	}
+	recordAudit(persV, auditDeletionTimestampSet, reason, map[string]string{annotationKey: date.Format(time.RFC3339)})
 	return nil
 }
 
-// Patch reclaim policy of the PV
-func patchPVReclaimingPolicy(pvName, policy string) error {
+// Sets (or removes, for empty values) several annotations of the Persistent Volume at once
+func setPVAnnotations(pvName string, annotations map[string]string) error {
+	values := map[string]interface{}{}
+	for key, value := range annotations {
+		if value == "" {
+			values[key] = nil
+		} else {
+			values[key] = value
+		}
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": values}})
+	if err != nil {
+		return err
+	}
+	_, err = kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(pvName, types.StrategicMergePatchType, patch)
+	if err != nil {
+		klog.Errorf("ERROR: patching annotations PV %s", err)
+		return err
+	}
+	return nil
+}
+
+// Patch reclaim policy of the PV, and records why in the audit trail
+func patchPVReclaimingPolicy(persV v1.PersistentVolume, policy, reason string) error {
 	patch := []byte(fmt.Sprintf(`{"spec": {"persistentVolumeReclaimPolicy": "%s"}}`, policy))
-	_, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(pvName, types.StrategicMergePatchType, patch)
+	_, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(persV.Name, types.StrategicMergePatchType, patch)
 	if err != nil {
 		klog.Errorf("ERROR: patching reclaim policy PV %s", err)
 		return err
 	}
+	recordAudit(persV, auditReclaimPolicySet, reason, map[string]string{"persistentVolumeReclaimPolicy": policy})
+	return nil
+}
+
+// Prepares a Released PV to be bound again to a new PVC with the same namespace/name as in its claimRef: removes the UID
+// of the deleted PVC from the claimRef, remembering it in annotationRestoringClaimUID to roll back. The reclaim
+// annotations are kept until the new PVC is bound, see finishPVRestore.
+func patchPVForRebinding(persV v1.PersistentVolume) error {
+	patch := []byte(fmt.Sprintf(`{"metadata": {"annotations": {"%s": "%s"}}, "spec": {"claimRef": {"uid": null, "resourceVersion": null}}}`,
+		annotationRestoringClaimUID, persV.Spec.ClaimRef.UID))
+	_, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(persV.Name, types.StrategicMergePatchType, patch)
+	if err != nil {
+		klog.Errorf("ERROR: patching claimRef PV %s", err)
+		return err
+	}
+	return nil
+}
+
+// Puts back the UID of the deleted PVC in the claimRef of a PV prepared for rebinding, so that it is Released again
+func rollbackPVRebinding(persV v1.PersistentVolume) error {
+	patch := []byte(fmt.Sprintf(`{"metadata": {"annotations": {"%s": null}}, "spec": {"claimRef": {"uid": "%s"}}}`,
+		annotationRestoringClaimUID, persV.ObjectMeta.Annotations[annotationRestoringClaimUID]))
+	_, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(persV.Name, types.StrategicMergePatchType, patch)
+	if err != nil {
+		klog.Errorf("ERROR: patching claimRef PV %s", err)
+		return err
+	}
+	return nil
+}
+
+// Once a restored PV is bound to its new PVC, removes the deletion timestamp, release time, retention extension, deletion
+// approval, content inspection, pre-delete hook and blocked deletion annotations: they were about the deleted PVC
+func finishPVRestore(pvName string) error {
+	removed := map[string]string{}
+	for _, key := range []string{annotationRestoringClaimUID, annotationDelete, annotationReleasedAt,
+		annotationRetentionExtendedBy, annotationRetentionExtensionReason, annotationOriginalDeletion,
+		annotationAwaitingApproval, annotationApprovedBy, annotationApprovedAt,
+		annotationInspectedAt, annotationContentFiles, annotationContentBytes, annotationInspectionError,
+		annotationPreDeleteHook, annotationDeletionBlocked} {
+		removed[key] = ""
+	}
+	return setPVAnnotations(pvName, removed)
+}
+
+// Sets the phase of a PV to Released, so that the PV controller applies its reclaim policy
+func patchPVPhaseReleased(pvName string) error {
+	patch := []byte(`{"status": {"phase": "Released", "message": ""}}`)
+	_, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(pvName, types.StrategicMergePatchType, patch, "status")
+	if err != nil {
+		klog.Errorf("ERROR: patching phase PV %s", err)
+		return err
+	}
 	return nil
 }
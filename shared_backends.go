@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// With static provisioning, several PVs can point at the same CephFS share. Deleting one of them destroys the data
+// of the others, so we index all PVs by backend identity at every run and refuse to delete shared backends.
+
+// PV names by backend identity, rebuilt at the start of every run
+var backendIndex = map[string][]string{}
+
+// The identities of the backend volume of a PV. A PV can have several (e.g. CSI volume handle and root path).
+func backendIdentities(persV v1.PersistentVolume) []string {
+	identities := []string{}
+	if csi := persV.Spec.CSI; csi != nil {
+		if csi.VolumeHandle != "" {
+			identities = append(identities, fmt.Sprintf("csi:%s:%s", csi.Driver, csi.VolumeHandle))
+		}
+		if rootPath := csi.VolumeAttributes["rootPath"]; rootPath != "" {
+			identities = append(identities, fmt.Sprintf("rootPath:%s:%s", csi.VolumeAttributes["clusterID"], strings.TrimSuffix(rootPath, "/")))
+		}
+	}
+	if cephfs := persV.Spec.CephFS; cephfs != nil {
+		monitors := append([]string{}, cephfs.Monitors...)
+		sort.Strings(monitors)
+		path := cephfs.Path
+		if path == "" {
+			path = "/"
+		}
+		identities = append(identities, fmt.Sprintf("cephfs:%s:%s", strings.Join(monitors, ","), path))
+	}
+	return identities
+}
+
+func indexBackends(pvs []v1.PersistentVolume) {
+	backendIndex = map[string][]string{}
+	for _, persV := range pvs {
+		for _, identity := range backendIdentities(persV) {
+			backendIndex[identity] = append(backendIndex[identity], persV.Name)
+		}
+	}
+}
+
+// Deletion guard: blocks the deletion of a PV whose backend volume is also referenced by another PV
+func sharedBackendGuard(persV v1.PersistentVolume, trigger string) string {
+	for _, identity := range backendIdentities(persV) {
+		for _, other := range backendIndex[identity] {
+			if other != persV.Name {
+				return fmt.Sprintf("its backend volume (%s) is also used by PV %s", identity, other)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// set by requestPVDeletion: when we asked for the PV to be deleted, to detect PVs that are never actually deleted
+	annotationReclaimRequested = "reclaim-volumes.cern.ch/reclaim-requested-timestamp"
+	// how many times the deletion of a stuck PV was re-triggered
+	annotationReclaimRetries = "reclaim-volumes.cern.ch/reclaim-retries"
+
+	auditReclaimRetried = "reclaim-retried"
+)
+
+var (
+	stuckReclaimTimeout    = flag.Duration("stuckReclaimTimeout", time.Hour, "report PVs whose reclaim policy was set to Delete and that still exist after this duration")
+	retryStuckReclaims     = flag.Bool("retryStuckReclaims", false, "re-trigger the deletion of stuck PVs")
+	stuckReclaimMaxRetries = flag.Int("stuckReclaimMaxRetries", 3, "with -retryStuckReclaims, maximum number of times the deletion of a PV is re-triggered")
+)
+
+// Whether we already set the PV to Delete: it is then up to the provisioner to delete it
+func pvReclaimWasRequested(persV v1.PersistentVolume) bool {
+	_, ok := persV.ObjectMeta.Annotations[annotationReclaimRequested]
+	return ok && persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete
+}
+
+// Reports PVs that should have been deleted by the provisioner a while ago (e.g. a CSI error left them Released or Failed),
+// and optionally re-triggers their deletion
+func checkStuckReclaim(persV v1.PersistentVolume) {
+	tRequested, err := time.Parse(time.RFC3339, persV.ObjectMeta.Annotations[annotationReclaimRequested])
+	if err != nil || time.Now().Before(tRequested.Add(*stuckReclaimTimeout)) {
+		return
+	}
+
+	summary.StuckReclaims++
+	klog.Warningf("WARNING: PV %s (phase %s) was set to Delete at %s and still exists: %s", persV.Name, persV.Status.Phase,
+		persV.ObjectMeta.Annotations[annotationReclaimRequested], persV.Status.Message)
+
+	if !*retryStuckReclaims || reclaimPausedReason() != "" {
+		return
+	}
+	retries, _ := strconv.Atoi(persV.ObjectMeta.Annotations[annotationReclaimRetries])
+	if retries >= *stuckReclaimMaxRetries {
+		return
+	}
+	if err := retriggerPVDeletion(persV, retries+1); err != nil {
+		klog.Errorf("ERROR: re-triggering deletion of PV %s - %v", persV.Name, err)
+		return
+	}
+	summary.RetriedReclaims++
+	recordAudit(persV, auditReclaimRetried, fmt.Sprintf("still present %v after deletion was requested: %s", time.Since(tRequested).Round(time.Minute), persV.Status.Message),
+		map[string]string{annotationReclaimRetries: strconv.Itoa(retries + 1)})
+}
+
+// The PV controller only deletes Released volumes: a Failed PV (or a Bound PV whose claim is missing) is put back to
+// Released. For a Released PV, updating its annotations is enough for the PV controller to process it (and try to delete it) again.
+func retriggerPVDeletion(persV v1.PersistentVolume, retry int) error {
+	klog.Infof("INFO: re-triggering deletion of PV %s (retry %d)", persV.Name, retry)
+	if persV.Status.Phase == v1.VolumeFailed || persV.Status.Phase == v1.VolumeBound {
+		if err := patchPVPhaseReleased(persV.Name); err != nil {
+			return err
+		}
+	}
+	return setPVAnnotations(persV.Name, map[string]string{
+		annotationReclaimRetries:   strconv.Itoa(retry),
+		annotationReclaimRequested: time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	api_errors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+// To look inside a Released PV, it is bound for a while to a PVC in an admin namespace. The original claimRef is kept
+// in an annotation and put back once that PVC is deleted, so the PV is Released again with its reclaim annotations
+// (deletion timestamp, release time...) untouched: the grace period is not affected.
+
+const annotationTemporaryBinding = "reclaim-volumes.cern.ch/temporary-binding"
+
+// Audit trail actions
+const (
+	auditTemporarilyBound      = "temporarily-bound"
+	auditTemporaryBindingEnded = "temporary-binding-ended"
+)
+
+// Purposes of temporary bindings
+const (
+	temporaryBindingInspection    = "inspection"
+	temporaryBindingPreDeleteHook = "pre-delete-hook"
+	temporaryBindingDebug         = "debug"
+)
+
+type temporaryBinding struct {
+	Purpose string `json:"purpose"`
+	// the claimRef of the PV before it was bound temporarily
+	ClaimRef *v1.ObjectReference `json:"claimRef"`
+	Since    time.Time           `json:"since"`
+}
+
+// The temporary binding of a PV, if it is temporarily bound
+func getTemporaryBinding(persV v1.PersistentVolume) (temporaryBinding, bool) {
+	binding := temporaryBinding{}
+	value, ok := persV.ObjectMeta.Annotations[annotationTemporaryBinding]
+	if !ok {
+		return binding, false
+	}
+	if err := json.Unmarshal([]byte(value), &binding); err != nil || binding.ClaimRef == nil {
+		klog.Errorf("ERROR: invalid annotation %s on PV %s", annotationTemporaryBinding, persV.Name)
+		return binding, false
+	}
+	return binding, true
+}
+
+// The claimRef of a PV as its users know it: the original one while it is bound temporarily
+func userClaimRef(persV v1.PersistentVolume) *v1.ObjectReference {
+	if binding, ok := getTemporaryBinding(persV); ok {
+		return binding.ClaimRef
+	}
+	return persV.Spec.ClaimRef
+}
+
+// Whether a PV is Released, or Bound temporarily while Released
+func pvIsReleased(persV v1.PersistentVolume) bool {
+	_, bound := getTemporaryBinding(persV)
+	return persV.Status.Phase == v1.VolumeReleased || bound
+}
+
+// Binds a Released PV to a new PVC namespace/claimName, pre-bound to the PV and requesting what it provides
+func bindPVTemporarily(persV v1.PersistentVolume, purpose, namespace, claimName string) error {
+	if persV.Status.Phase != v1.VolumeReleased || persV.Spec.ClaimRef == nil {
+		return fmt.Errorf("PV %s is not Released", persV.Name)
+	}
+	if persV.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimDelete {
+		return fmt.Errorf("PV %s is being deleted", persV.Name)
+	}
+	if _, ok := persV.ObjectMeta.Annotations[annotationTemporaryBinding]; ok {
+		return fmt.Errorf("PV %s is already bound temporarily", persV.Name)
+	}
+
+	binding, err := json.Marshal(temporaryBinding{Purpose: purpose, ClaimRef: persV.Spec.ClaimRef, Since: time.Now()})
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]string{annotationTemporaryBinding: string(binding)}},
+		"spec": map[string]interface{}{"claimRef": map[string]interface{}{
+			"namespace": namespace, "name": claimName, "uid": nil, "resourceVersion": nil,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(persV.Name, types.StrategicMergePatchType, patch); err != nil {
+		return fmt.Errorf("patching claimRef of PV %s - %v", persV.Name, err)
+	}
+
+	storageClassName := persV.Spec.StorageClassName
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      claimName,
+			Namespace: namespace,
+			Labels:    map[string]string{managedByLabel: managedByValue},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: persV.Spec.AccessModes,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: persV.Spec.Capacity[v1.ResourceStorage]},
+			},
+			VolumeName:       persV.Name,
+			StorageClassName: &storageClassName,
+			VolumeMode:       persV.Spec.VolumeMode,
+		},
+	}
+	if _, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims(namespace).Create(claim); err != nil && !api_errors.IsAlreadyExists(err) {
+		// the PV is pre-bound to a PVC that does not exist: undo, nothing was bound
+		if persV.ObjectMeta.Annotations == nil {
+			persV.ObjectMeta.Annotations = map[string]string{}
+		}
+		persV.ObjectMeta.Annotations[annotationTemporaryBinding] = string(binding)
+		restoreClaimRef(persV)
+		return fmt.Errorf("creating PVC %s/%s - %v", namespace, claimName, err)
+	}
+	klog.Infof("INFO: PV %s bound temporarily to PVC %s/%s for %s", persV.Name, namespace, claimName, purpose)
+	recordAudit(persV, auditTemporarilyBound, purpose, map[string]string{"claim": namespace + "/" + claimName})
+	return nil
+}
+
+// Ends the temporary binding of a PV: deletes its temporary PVC and, once it is gone, puts the original claimRef back.
+// Returns whether the PV has its original claimRef again; if not, call it again later.
+func releaseTemporaryBinding(persV v1.PersistentVolume) (bool, error) {
+	if _, ok := getTemporaryBinding(persV); !ok {
+		return true, nil
+	}
+	if claimRef := persV.Spec.ClaimRef; claimRef != nil {
+		claimsClient := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims(claimRef.Namespace)
+		claim, err := claimsClient.Get(claimRef.Name, meta_v1.GetOptions{})
+		if err == nil {
+			// kept by its protection finalizer while a pod uses it
+			if claim.DeletionTimestamp == nil {
+				if err := claimsClient.Delete(claimRef.Name, &meta_v1.DeleteOptions{}); err != nil && !api_errors.IsNotFound(err) {
+					return false, fmt.Errorf("deleting PVC %s/%s - %v", claimRef.Namespace, claimRef.Name, err)
+				}
+			}
+			return false, nil
+		} else if !api_errors.IsNotFound(err) {
+			return false, fmt.Errorf("getting PVC %s/%s - %v", claimRef.Namespace, claimRef.Name, err)
+		}
+	}
+	if err := restoreClaimRef(persV); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Puts back the claimRef saved in the temporary binding annotation and removes the annotation. The claim it refers to
+// was deleted, so the PV controller keeps (or puts) the PV in the Released phase.
+func restoreClaimRef(persV v1.PersistentVolume) error {
+	binding, ok := getTemporaryBinding(persV)
+	if !ok {
+		return nil
+	}
+	claimRef := binding.ClaimRef
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{annotationTemporaryBinding: nil}},
+		"spec": map[string]interface{}{"claimRef": map[string]interface{}{
+			"kind": claimRef.Kind, "apiVersion": claimRef.APIVersion, "namespace": claimRef.Namespace, "name": claimRef.Name,
+			"uid": claimRef.UID, "resourceVersion": claimRef.ResourceVersion,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := kubeclient.kubeclient.CoreV1().PersistentVolumes().Patch(persV.Name, types.StrategicMergePatchType, patch); err != nil {
+		klog.Errorf("ERROR: restoring claimRef of PV %s - %v", persV.Name, err)
+		return err
+	}
+	if err := patchPVPhaseReleased(persV.Name); err != nil {
+		return err
+	}
+	klog.Infof("INFO: PV %s refers to its former PVC %s/%s again after its temporary binding for %s", persV.Name, claimRef.Namespace, claimRef.Name, binding.Purpose)
+	recordAudit(persV, auditTemporaryBindingEnded, binding.Purpose, map[string]string{"claim": claimRef.Namespace + "/" + claimRef.Name})
+	return nil
+}
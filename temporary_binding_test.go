@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A Released PV of project/data, bound temporarily to a PVC of the admin namespace
+func testTemporarilyBoundPV(t *testing.T) v1.PersistentVolume {
+	original := &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "project", Name: "data", UID: "uid-data"}
+	binding, err := json.Marshal(temporaryBinding{Purpose: temporaryBindingDebug, ClaimRef: original, Since: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v1.PersistentVolume{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "pv-test", Annotations: map[string]string{
+			annotationTemporaryBinding: string(binding),
+			annotationDelete:           time.Now().Add(24 * time.Hour).Format(time.RFC3339),
+		}},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			ClaimRef:                      &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "admin", Name: debugName("pv-test")},
+		},
+		Status: v1.PersistentVolumeStatus{Phase: v1.VolumeBound},
+	}
+}
+
+func TestTemporarilyBoundPVKeepsItsOwner(t *testing.T) {
+	persV := testTemporarilyBoundPV(t)
+
+	if claimRef := userClaimRef(persV); claimRef.Namespace != "project" || claimRef.Name != "data" {
+		t.Errorf("claimRef of the owner is %s/%s, expected project/data", claimRef.Namespace, claimRef.Name)
+	}
+	if entry, ok := pendingDeletionOf(persV); !ok || entry.ClaimName != "data" {
+		t.Errorf("pending deletion is %+v, %v, expected one of PVC data", entry, ok)
+	}
+	if !(preDeleteHook{Name: "backup", Namespaces: []string{"project"}}).applies(persV) {
+		t.Errorf("pre-delete hook of the namespace of the owner does not apply")
+	}
+	request := VolumeRestoreRequest{ObjectMeta: meta_v1.ObjectMeta{Namespace: "project"}, Spec: VolumeRestoreRequestSpec{ClaimName: "data"}}
+	if found, ok := findVolumeToRestore(request, []v1.PersistentVolume{persV}); !ok || found.Name != "pv-test" {
+		t.Errorf("PV to restore not found")
+	}
+}
@@ -85,6 +85,18 @@ function checkPVMarkedForDeletion {
     fi
 }
 
+function checkPVReclaimPolicy {
+    pv_name=$1
+    expected_value=$2
+
+    actual_value=$(oc get pv/$pv_name -o go-template='{{.spec.persistentVolumeReclaimPolicy}}')
+
+    if ! test "${actual_value}" == "${expected_value}"; then
+        echo "TEST FAILED: expected reclaim policy '${expected_value}' for PV '${pv_name}', got ${actual_value}"
+        return 1
+    fi
+}
+
 
 # e.g. checkDeleteannotation myPV == somevalue
 # or checkDeleteannotation myPV != somevalue
@@ -102,6 +114,77 @@ function checkDeleteAnnotation {
     fi
 }
 
+function pvPhaseIs {
+    test "$(oc get pv/$1 -o go-template='{{.status.phase}}')" == "$2"
+}
+
+function pvHasAnnotation {
+    test "$(oc get pv/$1 -o json | jq -r ".metadata.annotations.\"$2\"")" != "null"
+}
+
+# e.g. requestPhaseIs volumerestorerequest/myPVC Completed, or requestPhaseIs pod/myPod Running
+function requestPhaseIs {
+    test "$(oc get $1 -o go-template='{{.status.phase}}')" == "$2"
+}
+
+# e.g. waitFor 60 "PV to be Released" pvPhaseIs myPV Released
+function waitFor {
+    timeout=$1
+    description=$2
+    shift 2
+    for i in $(seq $timeout); do
+        if "$@" > /dev/null 2>&1; then
+            return 0
+        fi
+        echo "Waiting for ${description}"
+        sleep 1
+    done
+    echo "TEST FAILED: no ${description} after ${timeout}s"
+    return 1
+}
+
+# Runs the reclaimer in controller mode in the background, with the remaining parameters as extra flags
+function startController {
+    controller_name=$1
+    shift
+    oc run $controller_name --image=$image_to_test --restart=Never -- controller -resyncPeriod=5s $*
+    waitFor 120 "controller to start" requestPhaseIs pod/$controller_name Running
+}
+
+function stopController {
+    controller_name=$1
+    oc logs pod/$controller_name
+    oc delete pod/$controller_name
+}
+
+# Installs the CRDs of the users' requests, as apiextensions.k8s.io/v1beta1 on the clusters without the v1 API
+function createCustomResourceDefinitions {
+    if oc apply -f "$(dirname $0)/../chart/crds/"; then
+        return 0
+    fi
+    for kind in VolumeRestoreRequest VolumeRetentionExtension; do
+        plural="$(echo $kind | tr '[:upper:]' '[:lower:]')s"
+        oc apply -f - <<EOF
+apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: ${plural}.reclaim-volumes.cern.ch
+spec:
+  group: reclaim-volumes.cern.ch
+  version: v1alpha1
+  scope: Namespaced
+  names:
+    kind: ${kind}
+    plural: ${plural}
+  subresources:
+    status: {}
+EOF
+    done
+    sleep 5 # for the API to serve them
+}
+
+createCustomResourceDefinitions
+
 
 echo "When a PV is not Released"
 echo "Then the PV should not be modified"
@@ -222,3 +305,80 @@ checkPVPhase $test_name "Released"
 checkDeleteAnnotation $test_name == "null"
 echo -e "OK\n"
 
+echo "When a PV is Released"
+echo "And a VolumeRestoreRequest is created for its PVC"
+echo "Then the PVC should be created again and bound to the PV"
+test_name="restore-released-pv"
+createBoundPV $test_name reclaim-volumes.cern.ch/deletion-grace-period-after-release="720h"
+releasePV $test_name
+waitFor 60 "PV to be Released" pvPhaseIs $test_name Released
+startController ${test_name}-controller
+oc create -f - <<EOF
+apiVersion: reclaim-volumes.cern.ch/v1alpha1
+kind: VolumeRestoreRequest
+metadata:
+  name: ${test_name}
+spec:
+  claimName: ${test_name}
+EOF
+waitFor 120 "VolumeRestoreRequest to be Completed" requestPhaseIs volumerestorerequest/$test_name Completed
+stopController ${test_name}-controller
+checkPVPhase $test_name "Bound"
+checkDeleteAnnotation $test_name == "null"
+echo -e "OK\n"
+
+echo "When a PV is Released"
+echo "And it has a delete annotation"
+echo "And a VolumeRetentionExtension is created for its PVC"
+echo "Then the delete annotation of the PV should be postponed"
+test_name="extend-retention"
+in_one_hour="$(date -u -d '+1 hour' +%Y-%m-%dT%H:%M:%SZ)"
+createBoundPV $test_name reclaim-volumes.cern.ch/deletion-grace-period-after-release="24h" reclaim-volumes.cern.ch/volume-reclaim-deletion-timestamp="${in_one_hour}"
+releasePV $test_name
+waitFor 60 "PV to be Released" pvPhaseIs $test_name Released
+oc create -f - <<EOF
+apiVersion: reclaim-volumes.cern.ch/v1alpha1
+kind: VolumeRetentionExtension
+metadata:
+  name: ${test_name}
+spec:
+  claimName: ${test_name}
+  extension: 168h
+  reason: migration in progress
+EOF
+runReclaimer $test_name
+checkPVPhase $test_name "Released"
+checkDeleteAnnotation $test_name != "${in_one_hour}"
+checkDeleteAnnotation $test_name != "null"
+requestPhaseIs volumeretentionextension/$test_name Completed
+echo -e "OK\n"
+
+echo "When a PV is Released"
+echo "And the date in the delete annotation has passed"
+echo "And deletions are paused"
+echo "Then the PV should not be marked for deletion"
+test_name="no-deletion-while-paused"
+oc create configmap reclaim-volumes-pause --from-literal=paused=true --from-literal=reason=test
+createBoundPV $test_name reclaim-volumes.cern.ch/deletion-grace-period-after-release="720h" reclaim-volumes.cern.ch/volume-reclaim-deletion-timestamp="2019-01-01T08:19:47Z"
+releasePV $test_name
+runReclaimer $test_name
+oc delete configmap/reclaim-volumes-pause
+checkPVPhase $test_name "Released"
+checkPVReclaimPolicy $test_name "Retain"
+echo -e "OK\n"
+
+echo "When a PV is Released"
+echo "And it has a grace period annotation"
+echo "And it was observed without ever being mounted since its creation"
+echo "Then the PV should be marked for deletion"
+test_name="reclaim-never-mounted"
+oc delete configmap/reclaim-volumes-mount-tracking --ignore-not-found
+startController ${test_name}-controller -reclaimNeverMounted
+# the mounts must be observed from before the PV is created on
+waitFor 60 "mounts to be observed" oc get configmap/reclaim-volumes-mount-tracking
+createBoundPV $test_name reclaim-volumes.cern.ch/deletion-grace-period-after-release="720h"
+waitFor 60 "PV to be tracked" pvHasAnnotation $test_name reclaim-volumes.cern.ch/mount-tracking-since
+releasePV $test_name
+waitFor 120 "PV to be marked for deletion" checkPVMarkedForDeletion $test_name
+stopController ${test_name}-controller
+echo -e "OK\n"
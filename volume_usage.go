@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storage_v1 "k8s.io/api/storage/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// A PV can be Released while a node still has it staged (stale VolumeAttachment) or while a pod in a terminating
+// namespace still mounts it. Its deletion is deferred while that is the case.
+
+var staleAttachmentThreshold = flag.Duration("staleAttachmentThreshold", 24*time.Hour, "report VolumeAttachments of Released PVs older than this")
+
+// VolumeAttachments, pods and PVCs of the cluster, listed once per run when first needed
+var (
+	volumeAttachments []storage_v1.VolumeAttachment
+	pods              []v1.Pod
+	claims            map[string]v1.PersistentVolumeClaim
+	volumeUsageListed bool
+)
+
+func resetVolumeUsage() {
+	volumeAttachments = nil
+	pods = nil
+	claims = nil
+	volumeUsageListed = false
+}
+
+func listVolumeUsage() error {
+	if volumeUsageListed {
+		return nil
+	}
+	attachmentList, err := kubeclient.kubeclient.StorageV1().VolumeAttachments().List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	podList, err := kubeclient.kubeclient.CoreV1().Pods("").List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	claimList, err := kubeclient.kubeclient.CoreV1().PersistentVolumeClaims("").List(meta_v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	volumeAttachments = attachmentList.Items
+	pods = podList.Items
+	claims = map[string]v1.PersistentVolumeClaim{}
+	for _, claim := range claimList.Items {
+		claims[claim.Namespace+"/"+claim.Name] = claim
+	}
+	volumeUsageListed = true
+	return nil
+}
+
+// VolumeAttachments of a PV
+func attachmentsOf(persV v1.PersistentVolume) []storage_v1.VolumeAttachment {
+	attachments := []storage_v1.VolumeAttachment{}
+	for _, attachment := range volumeAttachments {
+		if name := attachment.Spec.Source.PersistentVolumeName; name != nil && *name == persV.Name {
+			attachments = append(attachments, attachment)
+		}
+	}
+	return attachments
+}
+
+// Pods, terminated or not, that refer to the (former) claim of a PV
+func podsReferencing(persV v1.PersistentVolume) []v1.Pod {
+	referencing := []v1.Pod{}
+	if persV.Spec.ClaimRef == nil {
+		return referencing
+	}
+	// pods refer to the claim by name: if a new PVC with the same name was created, the pods use its volume instead
+	if claim, ok := claims[persV.Spec.ClaimRef.Namespace+"/"+persV.Spec.ClaimRef.Name]; ok && claim.Spec.VolumeName != persV.Name {
+		return referencing
+	}
+	for _, pod := range pods {
+		if pod.Namespace != persV.Spec.ClaimRef.Namespace {
+			continue
+		}
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == persV.Spec.ClaimRef.Name {
+				referencing = append(referencing, pod)
+				break
+			}
+		}
+	}
+	return referencing
+}
+
+// Pods that are not terminated and use the (former) claim of a PV
+func podsUsing(persV v1.PersistentVolume) []v1.Pod {
+	using := []v1.Pod{}
+	for _, pod := range podsReferencing(persV) {
+		if pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+			using = append(using, pod)
+		}
+	}
+	return using
+}
+
+// Deletion guard: defers the deletion while the volume is attached to a node or used by a pod
+func volumeInUseGuard(persV v1.PersistentVolume, trigger string) string {
+	if err := listVolumeUsage(); err != nil {
+		// be conservative: if we cannot tell, do not delete
+		return fmt.Sprintf("cannot check whether the volume is still in use - %v", err)
+	}
+	if attachments := attachmentsOf(persV); len(attachments) > 0 {
+		return fmt.Sprintf("the volume is still attached to node %s (VolumeAttachment %s)", attachments[0].Spec.NodeName, attachments[0].Name)
+	}
+	if using := podsUsing(persV); len(using) > 0 {
+		return fmt.Sprintf("the volume is still used by pod %s/%s", using[0].Namespace, using[0].Name)
+	}
+	return ""
+}
+
+// Reports the VolumeAttachments of a Released PV that have been there for longer than staleAttachmentThreshold
+func reportStaleAttachments(persV v1.PersistentVolume) {
+	if err := listVolumeUsage(); err != nil {
+		klog.Errorf("ERROR: listing VolumeAttachments and pods - %v", err)
+		return
+	}
+	for _, attachment := range attachmentsOf(persV) {
+		if time.Since(attachment.CreationTimestamp.Time) > *staleAttachmentThreshold {
+			summary.StaleAttachments++
+			klog.Warningf("WARNING: PV %s is Released but still attached to node %s since %v (VolumeAttachment %s)",
+				persV.Name, attachment.Spec.NodeName, attachment.CreationTimestamp.Time, attachment.Name)
+		}
+	}
+}